@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// targetDiff is the difference between the targets which should be running
+// and the ones which are (see --diff)
+type targetDiff struct {
+	// missing should be running, but aren't
+	missing []string
+	// extra are running, but shouldn't be
+	extra []string
+	// running are running and should be
+	running map[string]bool
+}
+
+// diffTargets compares the given targets (and what they depend on) with what
+// is actually running. Only targets in the same config files as the given
+// targets and with a runner which can tell if they're alive are considered.
+func (d *doo) diffTargets(names []string) (*targetDiff, error) {
+	wanted := make(map[string]bool)
+	for _, name := range d.plannedTargets(names, false) {
+		wanted[name] = true
+	}
+	d.reset()
+
+	configs := make(map[*dooConfig]bool)
+	for _, name := range names {
+		configs[d.targetMap[name].config] = true
+	}
+
+	diff := &targetDiff{running: make(map[string]bool)}
+	for _, t := range d.targets {
+		checker, ok := runners[t.Runner].(liveChecker)
+		if !ok || !configs[t.config] || !t.supportsPlatform() {
+			continue
+		}
+
+		alive, err := checker.alive(t)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", t.Name, err)
+		}
+		switch {
+		case alive && wanted[t.Name]:
+			diff.running[t.Name] = true
+		case alive:
+			diff.extra = append(diff.extra, t.Name)
+		case wanted[t.Name]:
+			diff.missing = append(diff.missing, t.Name)
+		}
+	}
+	sort.Strings(diff.missing)
+	sort.Strings(diff.extra)
+	return diff, nil
+}
+
+// applyDiff stops the extra targets and then starts the given targets,
+// leaving the ones which are already running alone. Returns false if anything
+// failed.
+func (d *doo) applyDiff(names []string, diff *targetDiff) bool {
+	ignoreDependencies := d.ignoreDependencies
+
+	d.reset()
+	d.ignoreDependencies = true
+	for _, name := range diff.extra {
+		d.createStopJob(name)
+	}
+	d.runAllJobs()
+	if d.didError {
+		return false
+	}
+
+	d.reset()
+	d.ignoreDependencies = ignoreDependencies
+	for _, name := range names {
+		d.createStartJob(name)
+	}
+	for name, job := range d.jobs {
+		if diff.running[name] {
+			d.markSatisfied(job)
+		}
+	}
+	d.runAllJobs()
+	return !d.didError && d.hasCompleted()
+}
@@ -1,13 +1,27 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -15,17 +29,69 @@ import (
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+const version = "0.2.0"
+
 // A Target is something that can be executed (by a runner)
 type Target struct {
 	Name         string
 	Dependencies []string
 	Invokes      []string
-	Cwd          string
-	Runner       string
-	Command      string
-	Listens      []string
-	dependants   []*Target
-	config       *dooConfig
+	Aliases      []string
+	Aggregate    bool
+	Manual       bool
+	// Disabled targets never run, but targets depending on them do
+	Disabled          bool
+	Interactive       bool
+	DetachWhenReady   bool
+	ProcessGroup      bool
+	Lock              bool
+	Platforms         []string
+	WaitFor           []string
+	After             []string
+	InvokesOnFailure  []string
+	Cwd               string
+	LogFile           string
+	Host              string
+	Runner            string
+	Command           string
+	Stdin             string
+	StdinFile         string
+	Output            bool
+	Sources           []string
+	Outputs           []string
+	Listens           []string
+	ListenDeadline    string
+	ReadyDelay        string
+	ListenFrom        string
+	Verify            string
+	Requires          []string
+	Color             string
+	VerifyStopped     bool
+	AfterStop         string
+	AfterStopOptional bool
+	Restart           string
+	RestartDelay      string
+	MaxRestarts       int
+	RestartWindow     string
+	ShellArgs         []string
+	Env               map[string]string
+	EnvClear          bool
+	EnvPassthrough    []string
+	SecretFiles       map[string]string
+	Templates         []templateFile
+	Nice              int
+	MemoryLimit       string
+	OpenFiles         int
+	Umask             string
+	Count             int
+	Matrix            []string
+	dependants        []*Target
+	config            *dooConfig
+	// secrets holds the contents of SecretFiles. They're kept out of Env so
+	// that they're never shown.
+	secrets map[string]string
+	// line is where the target is defined in the config (if known)
+	line int
 }
 
 const (
@@ -44,6 +110,29 @@ type Job struct {
 	startedAt       *time.Time
 	completedAt     *time.Time
 	err             error
+	cleanup         bool
+	readyAt         *time.Time
+	waitCount       int
+	waitingJobs     []*Job
+	// kill makes a stop job use the runner's hard kill
+	kill bool
+	// command is the command with outputs of other targets expanded
+	command    string
+	commandErr error
+	output     string
+	// satisfied is set for jobs which were already done before the run or
+	// whose outputs are up to date
+	satisfied bool
+	// background is set for exclusive jobs which keep running after they
+	// became ready
+	background bool
+	// alreadyRunning is set by the job when the runner found the target
+	// running before it was started
+	alreadyRunning bool
+	// done is set by the scheduler once it has handled the completion.
+	// Unlike completedAt (which the job sets itself) it's safe to check
+	// while the job runs.
+	done bool
 }
 
 type jobMap map[string]*Job
@@ -51,30 +140,97 @@ type jobMap map[string]*Job
 type doo struct {
 	targets            []*Target
 	targetMap          map[string]*Target
+	aliasMap           map[string]*Target
 	jobs               jobMap
 	startedJobs        int
 	completedJobs      int
 	didError           bool
+	afterError         bool
 	completion         chan *Job
+	readiness          chan *Job
 	homeDir            string
-	isExclusiveRunning bool
+	loadedFiles        map[string]bool
+	warnings           []string
+	out                io.Writer
 	ignoreDependencies bool
+	// ignoreInvokes makes stopping a target leave what it invoked alone
+	ignoreInvokes bool
+	dryRun        bool
+	kill          bool
+	useColor      bool
+	runnerLimits  map[string]int
+	// runnerJobs counts the jobs in flight for each runner
+	runnerJobs map[string]int
+	// exclusiveJob is the exclusive job which currently has the terminal (if
+	// any). It gives it up when it completes or becomes ready.
+	exclusiveJob *Job
+	// backgroundJobs counts exclusive jobs which became ready and keep running
+	// in the background
+	backgroundJobs int
+	// maxJobs limits how many jobs run at once (0 means no limit)
+	maxJobs int
+	// lockAll locks every target while starting it (see --lock)
+	lockAll bool
+	// ctx is passed to the runners. Cancelling it stops the jobs.
+	ctx     context.Context
+	outputs map[string]map[string]string
+	events  *eventLog
+	// onComplete is called in a goroutine after each job. runAllJobs waits
+	// for the calls before it returns.
+	onComplete    func(*Job)
+	completeHooks sync.WaitGroup
+	// env selects the NAME.ENV.toml overlays to apply
+	env       string
+	createCwd bool
+	// allowedRunners restricts which runners targets can use (if non-nil)
+	allowedRunners map[string]bool
+	// monitorTick triggers printMonitor. It's nil (and never fires) without
+	// --monitor.
+	monitorTick <-chan time.Time
+	// cleanup is set once a failed job has invoked other targets. From then on
+	// only jobs needed by those invokes are started.
+	cleanup bool
 }
 
 type dooDefault struct {
-	Cwd string
+	Cwd            string
+	Runner         string
+	Listens        []string
+	ListenDeadline string
+	ReadyDelay     string
+	LogFile        string
+	Env            map[string]string
+	ShellArgs      []string
+	// Target is run when doo is called without any targets
+	Target string
+	// RunnerLimits caps the number of jobs of a runner type that can be in
+	// flight at the same time
+	RunnerLimits map[string]int
+}
+
+// dooHooks run once before/after the jobs of a config
+type dooHooks struct {
+	Before string
+	After  string
 }
 
 type dooConfig struct {
 	Path     string
+	Version  string
 	Defaults dooDefault
+	Hooks    dooHooks
 	Targets  []*Target
 }
 
 func newDoo() *doo {
 	var d doo
 	d.reset()
+	d.ctx = context.Background()
 	d.completion = make(chan *Job)
+	d.readiness = make(chan *Job)
+	d.loadedFiles = make(map[string]bool)
+	d.runnerLimits = make(map[string]int)
+	d.out = &syncWriter{w: os.Stdout}
 	usr, err := user.Current()
 	if err == nil {
 		d.homeDir = usr.HomeDir
@@ -87,18 +243,36 @@ func (d *doo) reset() {
 	d.startedJobs = 0
 	d.completedJobs = 0
 	d.didError = false
+	d.afterError = false
+	d.cleanup = false
+	d.exclusiveJob = nil
+	d.backgroundJobs = 0
+	d.runnerJobs = make(map[string]int)
+	d.outputs = make(map[string]map[string]string)
+}
+
+var knownPlatforms = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true,
+	"freebsd": true, "illumos": true, "ios": true, "js": true, "linux": true,
+	"netbsd": true, "openbsd": true, "plan9": true, "solaris": true,
+	"wasip1": true, "windows": true,
 }
 
 func (d *doo) validateTargets(errs *[]string) {
 	d.targetMap = make(map[string]*Target)
+	d.aliasMap = make(map[string]*Target)
 
 	addError := func(f string, args ...interface{}) {
 		*errs = append(*errs, fmt.Sprintf(f, args...))
 	}
 
+	addWarning := func(f string, args ...interface{}) {
+		d.warnings = append(d.warnings, fmt.Sprintf(f, args...))
+	}
+
 	// First build targetMap
 	for _, target := range d.targets {
-		path := target.config.Path
+		path := target.location()
 		name := target.Name
 
 		if len(name) == 0 {
@@ -110,14 +284,182 @@ func (d *doo) validateTargets(errs *[]string) {
 			if other.config == target.config {
 				addError("Duplicate definition for %s in %s", name, path)
 			} else {
-				addError("Duplicate definition for %s in %s and %s", name, path, other.config.Path)
+				addError("Duplicate definition for %s in %s and %s", name, path, other.location())
 			}
 		}
 
 		if !isValidRunner(target.Runner) {
 			addError("Target %s in %s has invalid runner: %s", name, path, target.Runner)
+		} else if d.allowedRunners != nil && !d.allowedRunners[target.Runner] {
+			addError("Target %s in %s uses runner %s which isn't allowed", name, path, target.Runner)
 		} else if target.Runner != "shell" && len(target.Command) == 0 {
 			addError("Target %s in %s is missing command", name, path)
+		} else if target.Runner == "ssh" && len(target.Host) == 0 {
+			addError("Target %s in %s is missing host", name, path)
+		}
+
+		for _, platform := range target.Platforms {
+			if !knownPlatforms[platform] {
+				addError("Target %s in %s has unknown platform: %s", name, path, platform)
+			}
+		}
+
+		if _, ok := colors[target.Color]; len(target.Color) > 0 && !ok {
+			addError("Target %s in %s has unknown color: %s", name, path, target.Color)
+		}
+
+		if len(target.ShellArgs) > 0 && !isCommandFlag(target.ShellArgs[len(target.ShellArgs)-1]) {
+			addError("Target %s in %s has invalid shellArgs (must end with -c): %v", name, path, target.ShellArgs)
+		}
+
+		if target.DetachWhenReady {
+			if target.Runner != "shell" || len(target.Listens) == 0 {
+				addError("Target %s in %s needs the shell runner and listens to detach when ready", name, path)
+			} else if target.Output {
+				addError("Target %s in %s can't publish its output when detaching", name, path)
+			}
+		} else if target.isExclusive() && len(target.Listens) > 0 {
+			// Only waitFor is satisfied once it listens
+			addWarning("%s runs in the foreground, so targets depending on it won't start until it exits (use waitFor to start once it listens, or detachWhenReady)", name)
+		}
+
+		if len(target.Sources) > 0 && len(target.Outputs) == 0 {
+			addError("Target %s in %s has sources, but no outputs", name, path)
+		}
+		if len(target.Outputs) > 0 && target.Output {
+			addError("Target %s in %s can't publish its output when it may be skipped as up to date", name, path)
+		}
+		for _, pattern := range append(append([]string{}, target.Sources...), target.Outputs...) {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				addError("Target %s in %s has an invalid pattern %s: %s", name, path, pattern, err)
+			}
+		}
+
+		if len(target.Stdin) > 0 || len(target.StdinFile) > 0 {
+			if target.Runner != "shell" && target.Runner != "ssh" {
+				addError("Target %s in %s sets stdin, but only the shell and ssh runners support it", name, path)
+			} else if len(target.Stdin) > 0 && len(target.StdinFile) > 0 {
+				addError("Target %s in %s can't set both stdin and stdinFile", name, path)
+			} else if len(target.StdinFile) > 0 {
+				if _, err := os.Stat(target.StdinFile); err != nil {
+					addError("Target %s in %s can't read stdinFile: %s", name, path, err)
+				}
+			}
+		}
+
+		if target.ProcessGroup && target.Runner != "shell" {
+			addError("Target %s in %s uses a process group, but only the shell runner supports it", name, path)
+		}
+
+		if target.Output && target.Runner != "shell" {
+			addError("Target %s in %s can only publish its output with the shell runner", name, path)
+		}
+
+		if len(target.LogFile) > 0 && target.Runner == "launchd" {
+			addError("Target %s in %s can't use logFile with the launchd runner (use StandardOutPath in the plist)", name, path)
+		}
+
+		if target.Interactive && target.Runner == "launchd" {
+			addError("Target %s in %s can't be interactive with the launchd runner", name, path)
+		}
+
+		if target.Nice < -20 || target.Nice > 19 {
+			addError("Target %s in %s has invalid nice (must be between -20 and 19): %d", name, path, target.Nice)
+		}
+
+		if len(target.MemoryLimit) > 0 {
+			if _, err := parseSize(target.MemoryLimit); err != nil {
+				addError("Target %s in %s has invalid memoryLimit: %s", name, path, err)
+			}
+		}
+
+		for _, addr := range target.Listens {
+			if strings.Contains(addr, "${") {
+				// Filled in by --matrix, which checks it then
+				continue
+			}
+			if err := checkListenAddr(addr); err != nil {
+				addError("Target %s in %s has invalid listens: %s", name, path, err)
+			}
+		}
+
+		if len(target.ListenFrom) > 0 {
+			if net.ParseIP(target.ListenFrom) == nil {
+				addError("Target %s in %s has invalid listenFrom (must be an IP): %s", name, path, target.ListenFrom)
+			} else if target.Runner == "ssh" {
+				addError("Target %s in %s can't use listenFrom with the ssh runner", name, path)
+			}
+		}
+
+		if len(target.ListenDeadline) > 0 {
+			if dur, err := time.ParseDuration(target.ListenDeadline); err != nil || dur <= 0 {
+				addError("Target %s in %s has invalid listenDeadline: %s", name, path, target.ListenDeadline)
+			}
+		}
+
+		if len(target.ReadyDelay) > 0 {
+			if dur, err := time.ParseDuration(target.ReadyDelay); err != nil || dur <= 0 {
+				addError("Target %s in %s has invalid readyDelay: %s", name, path, target.ReadyDelay)
+			}
+		}
+
+		target.secrets = nil
+		for key, fpath := range target.SecretFiles {
+			if len(fpath) == 0 {
+				addError("Target %s in %s has empty secretFile for %s", name, path, key)
+				continue
+			}
+			data, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				addError("Target %s in %s can't read secret file for %s: %s", name, path, key, err)
+				continue
+			}
+			if target.secrets == nil {
+				target.secrets = make(map[string]string)
+			}
+			target.secrets[key] = strings.TrimSpace(string(data))
+		}
+
+		if len(target.Umask) > 0 {
+			if mask, err := strconv.ParseUint(target.Umask, 8, 32); err != nil || mask > 0777 {
+				addError("Target %s in %s has invalid umask (must be octal, e.g. 022): %s", name, path, target.Umask)
+			} else if target.Runner == "launchd" {
+				addError("Target %s in %s can't set umask with the launchd runner", name, path)
+			}
+		}
+
+		for _, tf := range target.Templates {
+			if len(tf.Source) == 0 || len(tf.Destination) == 0 {
+				addError("Target %s in %s has a template without source or destination", name, path)
+			} else if _, err := tf.parse(); err != nil {
+				addError("Target %s in %s has invalid template: %s", name, path, err)
+			} else if target.Runner == "ssh" {
+				addError("Target %s in %s can't render templates with the ssh runner", name, path)
+			}
+		}
+
+		switch target.Restart {
+		case "", "never":
+		case "on-failure", "always":
+			if _, ok := runners[target.Runner].(liveChecker); !ok {
+				addError("Target %s in %s can't restart with the %s runner", name, path, target.Runner)
+			}
+		default:
+			addError("Target %s in %s has invalid restart (must be never, on-failure or always): %s", name, path, target.Restart)
+		}
+
+		for key, val := range map[string]string{"restartDelay": target.RestartDelay, "restartWindow": target.RestartWindow} {
+			if dur, err := time.ParseDuration(val); len(val) > 0 && (err != nil || dur < 0) {
+				addError("Target %s in %s has invalid %s: %s", name, path, key, val)
+			}
+		}
+
+		if target.MaxRestarts < 0 {
+			addError("Target %s in %s has invalid maxRestarts: %d", name, path, target.MaxRestarts)
+		}
+
+		if target.OpenFiles < 0 {
+			addError("Target %s in %s has invalid openFiles: %d", name, path, target.OpenFiles)
 		}
 
 		d.targetMap[name] = target
@@ -125,15 +467,87 @@ func (d *doo) validateTargets(errs *[]string) {
 
 	// Set up dependants
 	for _, target := range d.targets {
+		for _, alias := range target.Aliases {
+			if other, ok := d.targetMap[alias]; ok {
+				addError("Alias %s of %s conflicts with target %s in %s", alias, target.Name, other.Name, other.location())
+			} else if other, ok := d.aliasMap[alias]; ok && other != target {
+				addError("Alias %s is used by both %s and %s", alias, other.Name, target.Name)
+			} else {
+				d.aliasMap[alias] = target
+			}
+		}
+
 		for _, dep := range target.Dependencies {
 			other, ok := d.targetMap[dep]
 			if ok {
 				other.dependants = append(other.dependants, target)
 			} else {
-				addError("%s depends on unknown target %s", target.Name, dep)
+				if fpath := d.findUnloadedTarget(filepath.Dir(target.config.Path), dep); len(fpath) > 0 {
+					addError("%s depends on unknown target %s (defined in %s, use '%s#%s')", target.Name, dep, fpath, filepath.Base(fpath), dep)
+				} else {
+					addError("%s depends on unknown target %s%s", target.Name, dep, d.suggest(dep))
+				}
+			}
+		}
+
+		for _, name := range outputRefs(target.Command) {
+			other, ok := d.targetMap[name]
+			if !ok {
+				addError("%s uses the output of unknown target %s%s", target.Name, name, d.suggest(name))
+			} else if !other.Output {
+				addError("%s uses the output of %s which doesn't set output = true", target.Name, name)
+			} else if !containsString(target.Dependencies, name) {
+				addError("%s uses the output of %s without depending on it", target.Name, name)
+			}
+		}
+
+		for _, name := range target.WaitFor {
+			if _, ok := d.targetMap[name]; !ok {
+				addError("%s waits for unknown target %s%s", target.Name, name, d.suggest(name))
+			}
+		}
+
+		for _, name := range target.After {
+			if _, ok := d.targetMap[name]; !ok {
+				addError("%s is ordered after unknown target %s%s", target.Name, name, d.suggest(name))
+			}
+		}
+
+		for _, names := range [][]string{target.Invokes, target.InvokesOnFailure} {
+			for _, pattern := range names {
+				if _, err := d.matchTargets(pattern); err != nil {
+					addError("%s invokes unknown target %s%s", target.Name, pattern, d.suggest(pattern))
+				}
+			}
+		}
+	}
+}
+
+// findUnloadedTarget looks for a definition of name in config files in dir
+// which haven't been loaded.
+func (d *doo) findUnloadedTarget(dir string, name string) string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	for _, file := range files {
+		fpath := filepath.Join(dir, file.Name())
+		if !isConfigFile(fpath) || d.loadedFiles[fpath] {
+			continue
+		}
+
+		var conf dooConfig
+		if _, err := decodeConfigFile(fpath, &conf); err != nil {
+			continue
+		}
+		for _, target := range conf.Targets {
+			if target.Name == name {
+				return fpath
 			}
 		}
 	}
+	return ""
 }
 
 func (d *doo) expandPath(path string, from string) string {
@@ -147,13 +561,44 @@ func (d *doo) expandPath(path string, from string) string {
 }
 
 func (d *doo) loadConfigFile(fpath string) error {
+	if abs, err := filepath.Abs(fpath); err == nil {
+		fpath = abs
+	}
+	d.loadedFiles[fpath] = true
+
 	dir := filepath.Dir(fpath)
 	conf := dooConfig{Path: fpath, Targets: nil}
-	md, err := toml.DecodeFile(fpath, &conf)
+	md, err := decodeConfigFile(fpath, &conf)
 	if err != nil {
 		return err
 	}
 
+	if lines := targetLines(fpath); len(lines) == len(conf.Targets) {
+		for i, target := range conf.Targets {
+			target.line = lines[i]
+		}
+	}
+
+	if len(d.env) > 0 && !isYAMLFile(fpath) {
+		overlay := strings.TrimSuffix(fpath, ".toml") + "." + d.env + ".toml"
+		if _, err := os.Stat(overlay); err == nil {
+			if err := applyOverlay(&conf, overlay); err != nil {
+				return fmt.Errorf("%s: %s", overlay, err)
+			}
+			d.loadedFiles[overlay] = true
+		}
+	}
+
+	if len(conf.Version) > 0 {
+		cmp, err := compareVersions(conf.Version, version)
+		if err != nil {
+			return err
+		}
+		if cmp > 0 {
+			return fmt.Errorf("config requires doo >= %s; you have %s", conf.Version, version)
+		}
+	}
+
 	keys := md.Undecoded()
 	if len(keys) > 0 {
 		return fmt.Errorf("unknown configuration: %v", keys)
@@ -164,323 +609,1934 @@ func (d *doo) loadConfigFile(fpath string) error {
 		defaultCwd = d.expandPath(conf.Defaults.Cwd, dir)
 	}
 
+	defaultRunner := conf.Defaults.Runner
+	if len(defaultRunner) == 0 {
+		defaultRunner = "shell"
+	} else if !isValidRunner(defaultRunner) {
+		return fmt.Errorf("invalid default runner: %s", defaultRunner)
+	}
+
+	for runner, limit := range conf.Defaults.RunnerLimits {
+		if !isValidRunner(runner) {
+			return fmt.Errorf("invalid runner in limits: %s", runner)
+		}
+		if limit < 1 {
+			return fmt.Errorf("runner limit for %s must be at least 1", runner)
+		}
+		// The strictest limit wins when several configs set one
+		if cur, ok := d.runnerLimits[runner]; !ok || limit < cur {
+			d.runnerLimits[runner] = limit
+		}
+	}
+
+	var expanded []*Target
+	for _, target := range conf.Targets {
+		instances, err := target.instances()
+		if err != nil {
+			return err
+		}
+		expanded = append(expanded, instances...)
+	}
+	conf.Targets = expanded
+
 	for _, target := range conf.Targets {
 		target.config = &conf
 
 		if len(target.Cwd) == 0 {
 			target.Cwd = defaultCwd
-		} else {
+		} else if len(target.Host) == 0 {
+			// Remote directories are used as they are
 			target.Cwd = d.expandPath(target.Cwd, dir)
 		}
 
-		if len(target.Runner) == 0 {
+		if len(target.Runner) == 0 && len(target.Command) > 0 {
+			target.Runner = defaultRunner
+		} else if len(target.Runner) == 0 {
+			// Targets without a command only group their dependencies
 			target.Runner = "shell"
 		}
-	}
-	d.targets = append(d.targets, conf.Targets...)
-	return nil
-}
 
-func addJobDependency(from, to *Job) {
-	from.dependencyCount++
-	to.dependentJobs = append(to.dependentJobs, from)
-}
+		if len(target.LogFile) == 0 {
+			target.LogFile = conf.Defaults.LogFile
+		}
+		if len(target.LogFile) > 0 {
+			logFile := strings.Replace(target.LogFile, "${name}", target.Name, -1)
+			target.LogFile = d.expandPath(logFile, dir)
+		}
 
-func (d *doo) createStartJob(name string) *Job {
-	job, ok := d.jobs[name]
+		if target.Listens == nil && len(target.Command) > 0 {
+			target.Listens = conf.Defaults.Listens
+		}
 
-	if ok {
-		return job
-	}
+		if target.ShellArgs == nil {
+			target.ShellArgs = conf.Defaults.ShellArgs
+		}
 
-	job = new(Job)
-	d.jobs[name] = job
+		if len(target.ListenDeadline) == 0 {
+			target.ListenDeadline = conf.Defaults.ListenDeadline
+		}
 
-	target := d.targetMap[name]
-	job.target = target
+		if len(target.ReadyDelay) == 0 {
+			target.ReadyDelay = conf.Defaults.ReadyDelay
+		}
 
-	depCount := len(target.Dependencies)
+		for key, fpath := range target.SecretFiles {
+			if len(fpath) > 0 {
+				target.SecretFiles[key] = d.expandPath(fpath, dir)
+			}
+		}
 
-	if d.ignoreDependencies || depCount == 0 {
-		return job
-	}
+		if len(target.StdinFile) > 0 {
+			target.StdinFile = d.expandPath(target.StdinFile, dir)
+		}
 
-	for _, dep := range target.Dependencies {
-		other := d.createStartJob(dep)
-		addJobDependency(job, other)
-	}
+		for i, pattern := range target.Sources {
+			target.Sources[i] = d.expandPath(pattern, dir)
+		}
+		for i, pattern := range target.Outputs {
+			target.Outputs[i] = d.expandPath(pattern, dir)
+		}
 
-	return job
+		for i, tf := range target.Templates {
+			if len(tf.Source) > 0 {
+				target.Templates[i].Source = d.expandPath(tf.Source, dir)
+			}
+			if len(tf.Destination) > 0 {
+				target.Templates[i].Destination = d.expandPath(tf.Destination, dir)
+			}
+		}
+
+		if len(conf.Defaults.Env) > 0 {
+			env := make(map[string]string)
+			for key, val := range conf.Defaults.Env {
+				env[key] = val
+			}
+			for key, val := range target.Env {
+				env[key] = val
+			}
+			target.Env = env
+		}
+	}
+	d.targets = append(d.targets, conf.Targets...)
+	return nil
 }
 
-func (d *doo) createStopJob(name string) *Job {
-	job, ok := d.jobs[name]
-	if ok {
-		return job
+// instances expands a target with count or matrix into one target per index
+// (or value). ${index} and ${value} are replaced in the name, command and
+// listens. If the name doesn't use them the index/value is appended.
+func (t *Target) instances() ([]*Target, error) {
+	if t.Count > 0 && len(t.Matrix) > 0 {
+		return nil, fmt.Errorf("target %s can't have both count and matrix", t.Name)
+	}
+	if t.Count < 0 {
+		return nil, fmt.Errorf("target %s has a negative count", t.Name)
 	}
 
-	job = new(Job)
-	job.mode = TargetStop
-	d.jobs[name] = job
+	values := t.Matrix
+	if t.Count > 0 {
+		for i := 0; i < t.Count; i++ {
+			values = append(values, strconv.Itoa(i))
+		}
+	}
+	if len(values) == 0 {
+		return []*Target{t}, nil
+	}
 
-	target := d.targetMap[name]
-	job.target = target
+	var res []*Target
+	for i, value := range values {
+		replacer := strings.NewReplacer("${index}", strconv.Itoa(i), "${value}", value)
+
+		instance := *t
+		instance.Count = 0
+		instance.Matrix = nil
+		// An alias can only point to a single target
+		instance.Aliases = nil
+		if strings.Contains(t.Name, "${index}") || strings.Contains(t.Name, "${value}") {
+			instance.Name = replacer.Replace(t.Name)
+		} else {
+			instance.Name = t.Name + "-" + value
+		}
+		instance.Command = replacer.Replace(t.Command)
+		instance.Listens = nil
+		for _, addr := range t.Listens {
+			instance.Listens = append(instance.Listens, replacer.Replace(addr))
+		}
+		res = append(res, &instance)
+	}
+	return res, nil
+}
 
-	if d.ignoreDependencies {
-		return job
+// matrixCells parses --matrix specs of the form VAR=A,B,C and returns every
+// combination of the values, in order
+func matrixCells(specs []string) ([][][2]string, error) {
+	cells := [][][2]string{nil}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid matrix: %s (expected VAR=A,B,C)", spec)
+		}
+
+		var next [][][2]string
+		for _, cell := range cells {
+			for _, value := range strings.Split(parts[1], ",") {
+				combined := append(append([][2]string{}, cell...), [2]string{parts[0], value})
+				next = append(next, combined)
+			}
+		}
+		cells = next
 	}
+	return cells, nil
+}
 
-	for _, other := range target.dependants {
-		otherJob := d.createStopJob(other.Name)
-		addJobDependency(job, otherJob)
+// addMatrixTargets creates an instance of each of the targets for every cell
+// of the matrix (see --matrix), with ${VAR} replaced in the command, listens
+// and env. Returns the names of the instances.
+func (d *doo) addMatrixTargets(names []string, specs []string) ([]string, error) {
+	cells, err := matrixCells(specs)
+	if err != nil {
+		return nil, err
 	}
 
-	return job
+	var res []string
+	for _, name := range names {
+		t := d.targetMap[name]
+		for _, cell := range cells {
+			var pairs, values []string
+			for _, kv := range cell {
+				pairs = append(pairs, "${"+kv[0]+"}", kv[1])
+				values = append(values, kv[1])
+			}
+			replacer := strings.NewReplacer(pairs...)
+
+			instance := *t
+			instance.Name = t.Name + "-" + strings.Join(values, "-")
+			instance.Aliases = nil
+			instance.dependants = nil
+			instance.Command = replacer.Replace(t.Command)
+			instance.Listens = nil
+			for _, addr := range t.Listens {
+				addr = replacer.Replace(addr)
+				// The target was validated before the values were filled in
+				if err := checkListenAddr(addr); err != nil {
+					return nil, fmt.Errorf("matrix instance %s has invalid listens: %s", instance.Name, err)
+				}
+				instance.Listens = append(instance.Listens, addr)
+			}
+			instance.Env = make(map[string]string)
+			for key, val := range t.Env {
+				instance.Env[key] = replacer.Replace(val)
+			}
+
+			if _, ok := d.targetMap[instance.Name]; ok {
+				return nil, fmt.Errorf("matrix instance %s conflicts with an existing target", instance.Name)
+			}
+			d.targets = append(d.targets, &instance)
+			d.targetMap[instance.Name] = &instance
+			res = append(res, instance.Name)
+		}
+	}
+	return res, nil
 }
 
-func (d *doo) hasRunningJobs() bool {
-	return d.startedJobs > d.completedJobs
+var targetHeader = regexp.MustCompile(`^\s*\[\[\s*targets\s*\]\]`)
+
+// targetLines finds the line of each [[targets]] header in a config file
+func targetLines(fpath string) []int {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil
+	}
+
+	var res []int
+	for i, line := range strings.Split(string(data), "\n") {
+		if targetHeader.MatchString(line) {
+			res = append(res, i+1)
+		}
+	}
+	return res
 }
 
-func (d *doo) hasCompleted() bool {
-	return d.completedJobs == len(d.jobs)
+// location describes where the target is defined, e.g. "doo.toml:12"
+func (t *Target) location() string {
+	if t.line > 0 {
+		return fmt.Sprintf("%s:%d", t.config.Path, t.line)
+	}
+	return t.config.Path
 }
 
-func (d *doo) startJob(job *Job) {
-	var now = time.Now()
-	job.startedAt = &now
-	d.startedJobs++
-	if job.target.isExclusive() {
-		d.isExclusiveRunning = true
+// isOverlayFile checks if the file is an environment overlay (NAME.ENV.toml)
+// of another config file in the same directory
+func isOverlayFile(fpath string) bool {
+	if filepath.Ext(fpath) != ".toml" {
+		return false
 	}
-	d.logStart(job)
-	go func() {
-		err := runJob(job)
-		var now = time.Now()
-		job.completedAt = &now
-		job.err = err
-		d.completion <- job
-	}()
+	base := strings.TrimSuffix(fpath, ".toml")
+	idx := strings.LastIndex(base, ".")
+	if idx <= len(filepath.Dir(fpath)) {
+		return false
+	}
+	_, err := os.Stat(base[:idx] + ".toml")
+	return err == nil
 }
 
-func (d *doo) didComplete(job *Job) {
-	d.completedJobs++
-	if job.target.isExclusive() {
-		d.isExclusiveRunning = false
+// applyOverlay applies the settings in an overlay to conf. Only the keys which
+// are set in the overlay are changed and targets are matched by name. New
+// targets are added.
+func applyOverlay(conf *dooConfig, fpath string) error {
+	var overlay struct {
+		Version  string
+		Defaults toml.Primitive
+		Hooks    toml.Primitive
+		Targets  []toml.Primitive
 	}
-	for _, other := range job.dependentJobs {
-		other.dependencyCount--
+	md, err := toml.DecodeFile(fpath, &overlay)
+	if err != nil {
+		return err
 	}
-	if job.err != nil {
-		d.didError = true
+
+	if md.IsDefined("defaults") {
+		if err := md.PrimitiveDecode(overlay.Defaults, &conf.Defaults); err != nil {
+			return err
+		}
 	}
 
-	if job.mode == TargetStart {
-		for _, name := range job.target.Invokes {
-			d.createStartJob(name)
+	if md.IsDefined("hooks") {
+		if err := md.PrimitiveDecode(overlay.Hooks, &conf.Hooks); err != nil {
+			return err
 		}
 	}
 
-	d.logComplete(job)
-}
+	for _, prim := range overlay.Targets {
+		var named struct{ Name string }
+		if err := md.PrimitiveDecode(prim, &named); err != nil {
+			return err
+		}
 
-func (d *doo) nextJob() *Job {
-	if d.isExclusiveRunning {
-		return nil
+		var target *Target
+		for _, other := range conf.Targets {
+			if other.Name == named.Name {
+				target = other
+			}
+		}
+		if target == nil {
+			target = new(Target)
+			conf.Targets = append(conf.Targets, target)
+		}
+		if err := md.PrimitiveDecode(prim, target); err != nil {
+			return err
+		}
+	}
+
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return fmt.Errorf("unknown configuration: %v", keys)
+	}
+	return nil
+}
+
+// resolveReferences handles dependencies and invokes of the form
+// "path/to/config.toml#target" by loading the referenced config file (if it
+// isn't loaded already) and replacing the reference with the target name.
+func (d *doo) resolveReferences() error {
+	// Loaded files append to d.targets so we can't use range here
+	for i := 0; i < len(d.targets); i++ {
+		target := d.targets[i]
+		dir := filepath.Dir(target.config.Path)
+
+		for _, names := range [][]string{target.Dependencies, target.WaitFor, target.After, target.Invokes, target.InvokesOnFailure} {
+			for j, name := range names {
+				idx := strings.LastIndex(name, "#")
+				if idx <= 0 {
+					continue
+				}
+
+				fpath := d.expandPath(name[:idx], dir)
+				if !d.loadedFiles[fpath] {
+					if err := d.loadConfigFile(fpath); err != nil {
+						return fmt.Errorf("failed to load %s (referenced by %s): %s", fpath, target.Name, err)
+					}
+				}
+				names[j] = name[idx+1:]
+			}
+		}
+	}
+	return nil
+}
+
+// compareVersions compares two versions of the form "1.2.3"
+func compareVersions(a, b string) (int, error) {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aNum, bNum int
+		var err error
+		if i < len(aParts) {
+			if aNum, err = strconv.Atoi(aParts[i]); err != nil {
+				return 0, fmt.Errorf("invalid version: %s", a)
+			}
+		}
+		if i < len(bParts) {
+			if bNum, err = strconv.Atoi(bParts[i]); err != nil {
+				return 0, fmt.Errorf("invalid version: %s", b)
+			}
+		}
+		if aNum != bNum {
+			if aNum < bNum {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func addJobDependency(from, to *Job) {
+	if to.done && to.err == nil {
+		// Jobs created by invokes can depend on jobs which are already done
+		return
+	}
+	if to.done {
+		// A failed dependency is never met
+		from.dependencyCount++
+		return
+	}
+	for _, job := range to.dependentJobs {
+		if job == from {
+			// e.g. a target listed twice in dependencies
+			return
+		}
+	}
+	from.dependencyCount++
+	to.dependentJobs = append(to.dependentJobs, from)
+}
+
+// isNeededBy checks if the other job (transitively) depends on or waits for
+// the job.
+func (j *Job) isNeededBy(other *Job) bool {
+	seen := make(map[*Job]bool)
+	queue := []*Job{j}
+	for len(queue) > 0 {
+		job := queue[0]
+		queue = queue[1:]
+		if job == other {
+			return true
+		}
+		if seen[job] {
+			continue
+		}
+		seen[job] = true
+		queue = append(queue, job.dependentJobs...)
+		queue = append(queue, job.waitingJobs...)
+	}
+	return false
+}
+
+func addJobWait(from, to *Job) {
+	if to.readyAt != nil {
+		return
+	}
+	for _, job := range to.waitingJobs {
+		if job == from {
+			return
+		}
+	}
+	from.waitCount++
+	to.waitingJobs = append(to.waitingJobs, from)
+}
+
+func (d *doo) createStartJob(name string) *Job {
+	job, ok := d.jobs[name]
+
+	if ok {
+		if d.cleanup && job.startedAt == nil {
+			d.markCleanup(job)
+		}
+		return job
+	}
+
+	job = new(Job)
+	job.cleanup = d.cleanup
+	d.jobs[name] = job
+
+	target := d.targetMap[name]
+	job.target = target
+
+	if d.ignoreDependencies {
+		return job
+	}
+
+	for _, dep := range target.Dependencies {
+		other := d.createStartJob(dep)
+		addJobDependency(job, other)
+	}
+
+	for _, name := range target.WaitFor {
+		other := d.createStartJob(name)
+		addJobWait(job, other)
+	}
+
+	return job
+}
+
+// markCleanup allows an already scheduled job (and its dependencies) to run
+// after a failure.
+func (d *doo) markCleanup(job *Job) {
+	if job.cleanup {
+		return
+	}
+	job.cleanup = true
+
+	if d.ignoreDependencies {
+		return
+	}
+
+	for _, dep := range job.target.Dependencies {
+		d.markCleanup(d.jobs[dep])
+	}
+	for _, name := range job.target.WaitFor {
+		d.markCleanup(d.jobs[name])
+	}
+}
+
+func (d *doo) createStopJob(name string) *Job {
+	job, ok := d.jobs[name]
+	if ok {
+		return job
+	}
+
+	job = new(Job)
+	job.mode = TargetStop
+	job.kill = d.kill
+	d.jobs[name] = job
+
+	target := d.targetMap[name]
+	job.target = target
+
+	// Stop what the target has invoked before the target itself
+	if !d.ignoreInvokes {
+		for _, other := range d.expandInvokes(target.Invokes) {
+			otherJob := d.createStopJob(other)
+			if otherJob == job || job.isNeededBy(otherJob) {
+				// Targets invoking each other; stop them in any order
+				continue
+			}
+			addJobDependency(job, otherJob)
+		}
+	}
+
+	if d.ignoreDependencies {
+		return job
+	}
+
+	for _, other := range target.dependants {
+		otherJob := d.createStopJob(other.Name)
+		addJobDependency(job, otherJob)
+	}
+
+	return job
+}
+
+func (d *doo) hasRunningJobs() bool {
+	return d.startedJobs > d.completedJobs
+}
+
+// hasRunnerCapacity reports whether another job using the given runner can be
+// started without exceeding its limit
+func (d *doo) hasRunnerCapacity(runner string) bool {
+	limit, ok := d.runnerLimits[runner]
+	if !ok {
+		return true
 	}
 
+	return d.runnerJobs[runner] < limit
+}
+
+func (d *doo) hasRunningCleanupJobs() bool {
 	for _, job := range d.jobs {
+		if job.cleanup && job.startedAt != nil && !job.done {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *doo) hasCompleted() bool {
+	return d.completedJobs == len(d.jobs)
+}
+
+// blockedJobs describes why each job which never started is stuck: the
+// dependencies which didn't complete, the targets it waits for which never
+// became ready and the targets it runs after which never started
+func (d *doo) blockedJobs() []string {
+	pendingDeps := make(map[*Job][]string)
+	pendingWaits := make(map[*Job][]string)
+	for name, job := range d.jobs {
+		if !job.done {
+			for _, other := range job.dependentJobs {
+				pendingDeps[other] = append(pendingDeps[other], name)
+			}
+		}
+		if job.readyAt == nil {
+			for _, other := range job.waitingJobs {
+				pendingWaits[other] = append(pendingWaits[other], name)
+			}
+		}
+	}
+
+	var res []string
+	for name, job := range d.jobs {
 		if job.startedAt != nil {
-			// Ignore running targets
 			continue
 		}
-		if job.dependencyCount > 0 {
-			// Missing dependencies
-			continue
+
+		var reasons []string
+		if deps := pendingDeps[job]; len(deps) > 0 {
+			sort.Strings(deps)
+			reasons = append(reasons, fmt.Sprintf("%d unmet dependencies (%s)", job.dependencyCount, strings.Join(deps, ", ")))
+		} else if job.dependencyCount > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d unmet dependencies", job.dependencyCount))
+		}
+		if waits := pendingWaits[job]; len(waits) > 0 {
+			sort.Strings(waits)
+			reasons = append(reasons, fmt.Sprintf("waits for %s", strings.Join(waits, ", ")))
+		}
+		var after []string
+		for _, other := range job.target.After {
+			if otherJob, ok := d.jobs[other]; ok && otherJob.startedAt == nil {
+				after = append(after, other)
+			}
+		}
+		if len(after) > 0 {
+			reasons = append(reasons, fmt.Sprintf("runs after %s", strings.Join(after, ", ")))
 		}
+		if len(reasons) == 0 {
+			reasons = append(reasons, "never scheduled")
+		}
+		res = append(res, fmt.Sprintf("%s: %s", name, strings.Join(reasons, "; ")))
+	}
+	sort.Strings(res)
+	return res
+}
 
-		if job.target.isExclusive() && d.hasRunningJobs() {
-			// Exclusive jobs can't run with other jobs
-			continue
+// prepareCwds checks the cwd of every target the run might start (including
+// the ones invoked along the way) before anything is started, so that a
+// missing directory doesn't leave the run half done.
+func (d *doo) prepareCwds() []string {
+	seen := make(map[string]bool)
+	var names []string
+	var visit func(name string)
+	visit = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		names = append(names, name)
+		t := d.targetMap[name]
+		for _, names := range [][]string{t.Invokes, t.InvokesOnFailure} {
+			for _, other := range d.expandInvokes(names) {
+				visit(other)
+			}
+		}
+	}
+	for name, job := range d.jobs {
+		if job.mode == TargetStart {
+			visit(name)
 		}
+	}
+	sort.Strings(names)
 
-		return job
+	var errs []string
+	for _, name := range names {
+		if err := d.prepareCwd(d.targetMap[name]); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	return errs
+}
+
+// prepareCwd checks that the cwd of a target exists, creating it with
+// --create-cwd (except in a dry run). This gives a clearer error than the
+// runner would.
+func (d *doo) prepareCwd(t *Target) error {
+	// Remote directories (and ones for other platforms) can't be checked
+	if len(t.Cwd) == 0 || t.Runner == "ssh" || !t.supportsPlatform() || t.Disabled {
+		return nil
 	}
 
+	fi, err := os.Stat(t.Cwd)
+	if os.IsNotExist(err) && d.createCwd && d.dryRun {
+		return nil
+	} else if os.IsNotExist(err) && d.createCwd {
+		if err := os.MkdirAll(t.Cwd, 0755); err != nil {
+			return fmt.Errorf("cwd can't be created: %s", err)
+		}
+		return nil
+	} else if os.IsNotExist(err) {
+		return fmt.Errorf("non-existent cwd: %s", t.Cwd)
+	} else if err == nil && !fi.IsDir() {
+		return fmt.Errorf("cwd isn't a directory: %s", t.Cwd)
+	}
 	return nil
 }
 
-func prettyDuration(dur time.Duration) string {
-	if dur >= time.Minute {
-		mins := dur / time.Minute
-		secs := float64(dur%time.Minute) / float64(time.Second)
-		return fmt.Sprintf("%dm%.3gs", mins, secs)
-	} else if dur >= time.Second {
-		return fmt.Sprintf("%.3gs", float64(dur)/float64(time.Second))
-	} else if dur >= time.Millisecond {
-		return fmt.Sprintf("%.3gms", float64(dur)/float64(time.Millisecond))
-	} else if dur >= time.Microsecond {
-		return fmt.Sprintf("%.3gµs", float64(dur)/float64(time.Microsecond))
+func (d *doo) startJob(job *Job) {
+	var now = time.Now()
+	job.startedAt = &now
+	d.startedJobs++
+	d.runnerJobs[job.target.Runner]++
+	if job.target.isExclusive() {
+		d.exclusiveJob = job
+	}
+
+	if job.mode == TargetStart && !d.dryRun && job.target.isUpToDate() {
+		job.satisfied = true
 	} else {
-		return fmt.Sprintf("%dns", dur)
+		d.logStart(job)
+	}
+
+	if job.mode == TargetStart && !job.satisfied && d.dryRun {
+		// Nothing publishes its output in a dry run
+		job.command = job.target.Command
+	} else if job.mode == TargetStart && !job.satisfied {
+		job.command, job.commandErr = d.expandOutputs(job.target.Command)
+	}
+
+	var ready func()
+	if len(job.waitingJobs) > 0 {
+		readiness := d.readiness
+		ready = func() {
+			// Never block: the scheduler might have stopped already (and
+			// then nobody cares)
+			select {
+			case readiness <- job:
+			default:
+			}
+		}
+	}
+
+	completion := d.completion
+	go func() {
+		err := job.commandErr
+		if err == nil && !d.dryRun && !job.satisfied {
+			err = d.runLocked(d.ctx, job, ready)
+		}
+		var now = time.Now()
+		job.completedAt = &now
+		job.err = err
+		completion <- job
+	}()
+}
+
+// releaseJob gives up the terminal (or the background slot) and the runner
+// capacity of a job which has completed
+func (d *doo) releaseJob(job *Job) {
+	d.runnerJobs[job.target.Runner]--
+	if d.exclusiveJob == job {
+		d.exclusiveJob = nil
+	}
+	if job.background {
+		job.background = false
+		d.backgroundJobs--
+	}
+}
+
+func (d *doo) didComplete(job *Job) {
+	job.done = true
+	d.completedJobs++
+	d.releaseJob(job)
+	for _, other := range job.dependentJobs {
+		other.dependencyCount--
+		if other.dependencyCount < 0 {
+			// A bug in the job graph; rather stop than run things out of order
+			other.dependencyCount = 0
+			d.didError = true
+			fmt.Fprintf(d.out, "!! internal error: dependency count of %s is negative\n", d.label(other.target))
+		}
+	}
+	if job.err != nil {
+		if d.isOnlyOrdering(job) {
+			// The jobs ordered after it don't need it to succeed. Keep going
+			// and fail the run once it's done.
+			d.afterError = true
+		} else {
+			d.didError = true
+		}
+	} else if job.mode == TargetStart {
+		if job.target.Output {
+			d.outputs[job.target.Name] = parseOutput(job.output)
+		}
+		d.didBecomeReady(job)
+	}
+
+	if job.mode == TargetStart && !job.target.Disabled {
+		if job.err == nil && !d.cleanup {
+			for _, name := range d.expandInvokes(job.target.Invokes) {
+				d.createStartJob(name)
+			}
+		} else if job.err != nil && len(job.target.InvokesOnFailure) > 0 {
+			d.cleanup = true
+			for _, name := range d.expandInvokes(job.target.InvokesOnFailure) {
+				d.createStartJob(name)
+			}
+		}
+	}
+
+	d.logComplete(job)
+	if d.onComplete != nil {
+		// The hook might be slow, so don't hold up the other jobs
+		d.completeHooks.Add(1)
+		go func() {
+			defer d.completeHooks.Done()
+			d.onComplete(job)
+		}()
+	}
+}
+
+// markSatisfied treats a job as completed without running it
+func (d *doo) markSatisfied(job *Job) {
+	job.satisfied = true
+	var now = time.Now()
+	job.startedAt = &now
+	job.completedAt = &now
+	job.done = true
+	d.startedJobs++
+	d.completedJobs++
+	for _, other := range job.dependentJobs {
+		other.dependencyCount--
+	}
+	d.didBecomeReady(job)
+}
+
+// didBecomeReady lets jobs waiting for this job run
+func (d *doo) didBecomeReady(job *Job) {
+	if job.readyAt != nil {
+		return
+	}
+	var now = time.Now()
+	job.readyAt = &now
+
+	if d.exclusiveJob == job {
+		// A ready service keeps running in the background
+		d.exclusiveJob = nil
+		job.background = true
+		d.backgroundJobs++
+	}
+
+	for _, other := range job.waitingJobs {
+		other.waitCount--
+	}
+}
+
+// checkRunners checks that the runners needed by the jobs are available
+func (d *doo) checkRunners() []string {
+	used := make(map[string]bool)
+	for _, job := range d.jobs {
+		if !job.isNoop() {
+			used[job.target.Runner] = true
+		}
+	}
+
+	var names []string
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []string
+	for _, name := range names {
+		if err := runners[name].check(); err != nil {
+			errs = append(errs, fmt.Sprintf("Runner %s is not available: %s", name, err))
+		}
+	}
+	return errs
+}
+
+// afterStarted checks that the targets the job is ordered after have started.
+// Unlike dependencies these targets aren't started because of the job.
+func (d *doo) afterStarted(job *Job) bool {
+	for _, name := range job.target.After {
+		if other, ok := d.jobs[name]; ok && other.startedAt == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// isOnlyOrdering checks if the job is only needed to order other jobs: no job
+// depends on or waits for it, but some job which hasn't started yet runs
+// after it.
+func (d *doo) isOnlyOrdering(job *Job) bool {
+	if job.mode != TargetStart || len(job.dependentJobs) > 0 || len(job.waitingJobs) > 0 {
+		return false
+	}
+	for _, other := range d.jobs {
+		if other.startedAt != nil {
+			continue
+		}
+		for _, name := range other.target.After {
+			if name == job.target.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (d *doo) nextJob() *Job {
+	if d.exclusiveJob != nil {
+		return nil
+	}
+
+	for _, job := range d.jobs {
+		if job.startedAt != nil {
+			// Ignore running targets
+			continue
+		}
+		if d.cleanup && !job.cleanup {
+			// Only failure invokes run after an error
+			continue
+		}
+		if job.dependencyCount > 0 || job.waitCount > 0 {
+			// Missing dependencies
+			continue
+		}
+		if job.mode == TargetStart && !d.afterStarted(job) {
+			continue
+		}
+
+		if job.target.isExclusive() && d.startedJobs-d.completedJobs > d.backgroundJobs {
+			// Exclusive jobs can't run with other jobs (but services in the
+			// background are fine)
+			continue
+		}
+
+		if d.maxJobs > 0 && d.startedJobs-d.completedJobs >= d.maxJobs {
+			// Too many jobs are in flight
+			return nil
+		}
+
+		if !d.hasRunnerCapacity(job.target.Runner) {
+			// Too many jobs of this runner are in flight
+			continue
+		}
+
+		return job
+	}
+
+	return nil
+}
+
+func prettyDuration(dur time.Duration) string {
+	if dur >= time.Minute {
+		mins := dur / time.Minute
+		secs := float64(dur%time.Minute) / float64(time.Second)
+		return fmt.Sprintf("%dm%.3gs", mins, secs)
+	} else if dur >= time.Second {
+		return fmt.Sprintf("%.3gs", float64(dur)/float64(time.Second))
+	} else if dur >= time.Millisecond {
+		return fmt.Sprintf("%.3gms", float64(dur)/float64(time.Millisecond))
+	} else if dur >= time.Microsecond {
+		return fmt.Sprintf("%.3gµs", float64(dur)/float64(time.Microsecond))
+	} else {
+		return fmt.Sprintf("%dns", dur)
+	}
+}
+
+// A syncWriter serializes writes so that lines written from different
+// goroutines don't get mixed up. Each call to Write must be a complete line.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+var colors = map[string]string{
+	"red":     "31",
+	"green":   "32",
+	"yellow":  "33",
+	"blue":    "34",
+	"magenta": "35",
+	"cyan":    "36",
+}
+
+// palette is used for targets without a color
+var palette = []string{"cyan", "magenta", "yellow", "green", "blue", "red"}
+
+// color returns the color of the target. It's based on the name so that it
+// stays the same between runs.
+func (t *Target) color() string {
+	if len(t.Color) > 0 {
+		return t.Color
+	}
+	h := fnv.New32a()
+	h.Write([]byte(t.Name))
+	return palette[h.Sum32()%uint32(len(palette))]
+}
+
+// label formats the name of a target for the log
+func (d *doo) label(t *Target) string {
+	if !d.useColor {
+		return t.Name
+	}
+	return fmt.Sprintf("\x1b[1;%sm%s\x1b[0m", colors[t.color()], t.Name)
+}
+
+func (d *doo) logStart(job *Job) {
+	if job.isNoop() {
+		return
+	}
+	action := "starting"
+	if job.mode == TargetStop {
+		action = "stopping"
+	}
+	if d.dryRun {
+		fmt.Fprintf(d.out, ">> %s %s (%s): %s\n", d.label(job.target), action, job.target.Runner, job.target.Command)
+		return
+	}
+	fmt.Fprintf(d.out, ">> %s %s\n", d.label(job.target), action)
+	d.logEvent(job, action)
+}
+
+func (d *doo) logComplete(job *Job) {
+	if job.isNoop() || d.dryRun {
+		return
+	}
+	if job.satisfied {
+		fmt.Fprintf(d.out, "== %s is up to date\n", d.label(job.target))
+		return
+	}
+	dur := job.completedAt.Sub(*job.startedAt)
+	fmt.Fprintf(d.out, "<< %s completed in %s\n", d.label(job.target), prettyDuration(dur))
+	if job.err != nil {
+		d.logEvent(job, "failed")
+	} else {
+		d.logEvent(job, "completed")
+	}
+	if job.err != nil {
+		var listenErr *ListenTimeoutError
+		if errors.As(job.err, &listenErr) {
+			fmt.Fprintf(d.out, "!! %s failed: didn't listen to %s after %d attempts\n", d.label(job.target), listenErr.Addr, listenErr.Attempts)
+		} else {
+			fmt.Fprintf(d.out, "!! %s failed: %v\n", d.label(job.target), job.err)
+		}
+	}
+}
+
+func (d *doo) runAllJobs() {
+	if !d.hasRunningJobs() && cap(d.completion) < len(d.jobs) {
+		// Buffer completions so finished jobs don't have to wait for the
+		// scheduler to pick them up
+		d.completion = make(chan *Job, len(d.jobs))
+	}
+	if !d.hasRunningJobs() && cap(d.readiness) < len(d.jobs) {
+		d.readiness = make(chan *Job, len(d.jobs))
+	}
+
+	for true {
+		if d.didError && !d.cleanup {
+			break
+		}
+
+		if d.hasCompleted() {
+			break
+		}
+
+		job := d.nextJob()
+		if job != nil {
+			d.startJob(job)
+		} else if d.cleanup && d.hasRunningCleanupJobs() || !d.cleanup && d.hasRunningJobs() {
+			select {
+			case job = <-d.completion:
+				d.didComplete(job)
+			case job = <-d.readiness:
+				d.didBecomeReady(job)
+			case now := <-d.monitorTick:
+				d.printMonitor(now)
+			}
+		} else {
+			break
+		}
+	}
+
+	if d.afterError {
+		d.didError = true
+	}
+	d.completeHooks.Wait()
+}
+
+// runConfigHooks runs a hook of every config which has a job in this run. The
+// hook runs in the directory of the config.
+func (d *doo) runConfigHooks(hook func(dooHooks) string) error {
+	seen := make(map[*dooConfig]bool)
+	var configs []*dooConfig
+	for _, job := range d.jobs {
+		if conf := job.target.config; !seen[conf] {
+			seen[conf] = true
+			configs = append(configs, conf)
+		}
+	}
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].Path < configs[j].Path
+	})
+
+	for _, conf := range configs {
+		command := hook(conf.Hooks)
+		if len(command) == 0 {
+			continue
+		}
+		cmd := exec.Command("bash", "-c", command)
+		cmd.Dir = filepath.Dir(conf.Path)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %s", conf.Path, err)
+		}
+	}
+	return nil
+}
+
+// defaultTarget returns the target to run when none are given: the one set
+// in the defaults of a config, or otherwise a target called "default" (if
+// there is one).
+func (d *doo) defaultTarget() (string, error) {
+	var name, from string
+	for _, t := range d.targets {
+		conf := t.config
+		if len(conf.Defaults.Target) == 0 || conf.Defaults.Target == name {
+			continue
+		}
+		if len(name) > 0 {
+			return "", fmt.Errorf("both %s and %s set a default target", from, conf.Path)
+		}
+		name, from = conf.Defaults.Target, conf.Path
+	}
+	if len(name) > 0 {
+		return name, nil
+	}
+
+	if _, ok := d.targetMap["default"]; ok {
+		return "default", nil
+	}
+	return "", nil
+}
+
+// plannedTargets returns every target a run would touch in the order they
+// would run, assuming that every target succeeds (so that invokes run too)
+func (d *doo) plannedTargets(names []string, stopMode bool) []string {
+	for _, name := range names {
+		if stopMode {
+			d.createStopJob(name)
+		} else {
+			d.createStartJob(name)
+		}
+	}
+
+	if !stopMode {
+		// Invoked jobs are usually only created once the invoker is done
+		seen := make(map[string]bool)
+		for changed := true; changed; {
+			changed = false
+			for name, job := range d.jobs {
+				if seen[name] {
+					continue
+				}
+				seen[name] = true
+				changed = true
+				for _, other := range d.expandInvokes(job.target.Invokes) {
+					d.createStartJob(other)
+				}
+			}
+		}
+	}
+
+	waves, leftover := d.waves()
+	var res []string
+	for _, wave := range waves {
+		res = append(res, wave...)
+	}
+	return append(res, leftover...)
+}
+
+// rollback stops the targets which this run has started, dependants first.
+// Targets which the runner found running already (e.g. an existing tmux
+// session) and targets which were satisfied without running are left alone,
+// and so is everything they invoke unless this run started it too.
+func (d *doo) rollback() {
+	// Wait for the jobs still in flight (e.g. tmux targets polling their
+	// listens) so that they're stopped too if they succeed and their late
+	// completions don't end up in the rollback run. Services running in the
+	// background never complete so there's no point in waiting for them.
+	for d.startedJobs-d.completedJobs > d.backgroundJobs {
+		select {
+		case job := <-d.completion:
+			job.done = true
+			d.completedJobs++
+			d.releaseJob(job)
+			d.logComplete(job)
+		case job := <-d.readiness:
+			d.didBecomeReady(job)
+		}
+	}
+
+	started := make(map[string]*Target)
+	for name, job := range d.jobs {
+		if job.mode == TargetStart && job.done && job.err == nil && !job.satisfied && !job.alreadyRunning && !job.isNoop() {
+			started[name] = job.target
+		}
+	}
+
+	d.reset()
+	// Background services might still complete; that mustn't count as a
+	// completion of the rollback
+	d.completion = make(chan *Job)
+	d.readiness = make(chan *Job)
+	d.ignoreDependencies = true
+	// Invoked targets are only stopped if this run started them as well
+	d.ignoreInvokes = true
+	if d.ctx.Err() != nil {
+		// An interrupted run is rolled back as well
+		d.ctx = context.Background()
+	}
+	for name := range started {
+		d.createStopJob(name)
+	}
+	for name, target := range started {
+		for _, other := range target.dependants {
+			if _, ok := started[other.Name]; ok {
+				addJobDependency(d.jobs[name], d.jobs[other.Name])
+			}
+		}
+	}
+	d.runAllJobs()
+}
+
+// preflight checks the runners of the jobs and prints the result for each
+// one. ssh hosts are checked separately. Returns false if anything failed.
+func (d *doo) preflight() bool {
+	users := make(map[string][]string)
+	hosts := make(map[string]*Target)
+	for name, job := range d.jobs {
+		if job.isNoop() {
+			continue
+		}
+		users[job.target.Runner] = append(users[job.target.Runner], name)
+		if job.target.Runner == "ssh" {
+			hosts[job.target.Host] = job.target
+		}
+	}
+
+	ok := true
+	report := func(what string, names []string, err error) {
+		sort.Strings(names)
+		if err != nil {
+			ok = false
+			fmt.Fprintf(d.out, "failed  %s (%s): %s\n", what, strings.Join(names, ", "), err)
+		} else {
+			fmt.Fprintf(d.out, "ok      %s (%s)\n", what, strings.Join(names, ", "))
+		}
+	}
+
+	var runnerNames []string
+	for name := range users {
+		runnerNames = append(runnerNames, name)
+	}
+	sort.Strings(runnerNames)
+	for _, name := range runnerNames {
+		report(name, users[name], runners[name].check())
+	}
+
+	var hostNames []string
+	for host := range hosts {
+		hostNames = append(hostNames, host)
+	}
+	sort.Strings(hostNames)
+	for _, host := range hostNames {
+		_, err := combinedOutputError(sshCommand(d.ctx, hosts[host], "true"))
+		report("ssh "+host, []string{hosts[host].Name}, err)
+	}
+	return ok
+}
+
+// checkHealth runs the readiness checks of the targets and prints the result
+// of each one. Returns false if any of them failed.
+func (d *doo) checkHealth(names []string) bool {
+	healthy := true
+	report := func(t *Target, probe string, err error) {
+		if err != nil {
+			healthy = false
+			fmt.Fprintf(d.out, "failed  %s %s: %s\n", d.label(t), probe, err)
+		} else {
+			fmt.Fprintf(d.out, "ok      %s %s\n", d.label(t), probe)
+		}
+	}
+
+	for _, name := range names {
+		t := d.targetMap[name]
+		if len(t.Listens) == 0 && len(t.Verify) == 0 {
+			fmt.Fprintf(d.out, "-       %s (nothing to check)\n", d.label(t))
+			continue
+		}
+
+		for _, addr := range t.Listens {
+			listens, err := t.checkListens(d.ctx, addr)
+			if err == nil && !listens {
+				err = errors.New("not listening")
+			}
+			report(t, addr, err)
+		}
+		if len(t.Verify) > 0 {
+			report(t, "verify", runHook(d.ctx, t, t.Verify))
+		}
+	}
+	return healthy
+}
+
+// waitReady waits for targets started by something else to listen and pass
+// verify. Returns false if any of them didn't.
+func (d *doo) waitReady(names []string) bool {
+	ok := true
+	for _, name := range names {
+		t := d.targetMap[name]
+		err := waitListens(d.ctx, t)
+		if err == nil && len(t.Verify) > 0 {
+			err = runHook(d.ctx, t, t.Verify)
+		}
+		if err != nil {
+			ok = false
+			fmt.Fprintf(d.out, "!! %s failed: %s\n", d.label(t), err)
+		} else {
+			fmt.Fprintf(d.out, "<< %s ready\n", d.label(t))
+		}
+	}
+	return ok
+}
+
+// explainTarget describes every path from the roots to the target called
+// name. Dependencies are shown as "a -> b" and invokes as "a ~> b".
+func (d *doo) explainTarget(roots []string, name string, stopMode bool) []string {
+	var res []string
+	var root string
+	seen := make(map[string]bool)
+
+	var visit func(target *Target, path string)
+	visit = func(target *Target, path string) {
+		if target.Name == name {
+			res = append(res, fmt.Sprintf("%s, because %s was requested", path, root))
+			return
+		}
+
+		seen[target.Name] = true
+		follow := func(other string, arrow string) {
+			if !seen[other] {
+				visit(d.targetMap[other], path+arrow+other)
+			}
+		}
+
+		if stopMode {
+			if !d.ignoreDependencies {
+				for _, other := range target.dependants {
+					follow(other.Name, " -> ")
+				}
+			}
+			for _, other := range d.expandInvokes(target.Invokes) {
+				follow(other, " ~> ")
+			}
+		} else {
+			if !d.ignoreDependencies {
+				for _, other := range target.Dependencies {
+					follow(other, " -> ")
+				}
+				for _, other := range target.WaitFor {
+					follow(other, " -> ")
+				}
+			}
+			for _, other := range d.expandInvokes(target.Invokes) {
+				follow(other, " ~> ")
+			}
+			for _, other := range d.expandInvokes(target.InvokesOnFailure) {
+				follow(other, " ~> ")
+			}
+		}
+		delete(seen, target.Name)
+	}
+
+	for _, root = range roots {
+		visit(d.targetMap[root], root)
+	}
+	return res
+}
+
+type targetInfo struct {
+	Name         string   `json:"name"`
+	Runner       string   `json:"runner"`
+	Cwd          string   `json:"cwd"`
+	Dependencies []string `json:"dependencies"`
+	Invokes      []string `json:"invokes"`
+	Listens      []string `json:"listens"`
+	Aliases      []string `json:"aliases"`
+	Source       string   `json:"source"`
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+func writeTargetsJSON(w io.Writer, targets []*Target) error {
+	infos := []targetInfo{}
+	for _, t := range targets {
+		infos = append(infos, targetInfo{
+			Name:         t.Name,
+			Runner:       t.Runner,
+			Cwd:          t.Cwd,
+			Dependencies: nonNil(t.Dependencies),
+			Invokes:      nonNil(t.Invokes),
+			Listens:      nonNil(t.Listens),
+			Aliases:      nonNil(t.Aliases),
+			Source:       t.config.Path,
+		})
+	}
+
+	data, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+var (
+	stop            = kingpin.Flag("stop", "Stop specified targets").Bool()
+	list            = kingpin.Flag("list", "List available targets").Bool()
+	load            = kingpin.Flag("load", "Load configuration file (can be a glob pattern)").PlaceHolder("CONFIG").Strings()
+	only            = kingpin.Flag("only", "Run only the given targets, skipping their dependencies (dependants with --stop). Invoked targets still run").Bool()
+	noDeps          = kingpin.Flag("no-deps", "Same as --only: run only the given targets, skipping their dependencies (dependants with --stop). Invoked targets still run").Bool()
+	showSource      = kingpin.Flag("show-source", "Include the config file of each target in --list").Bool()
+	pwd             = kingpin.Flag("pwd", "Prints the directory for the target").Bool()
+	supervise       = kingpin.Flag("supervise", "Keep running after starting the targets and reload the configuration on SIGHUP").Bool()
+	attachAll       = kingpin.Flag("attach-all", "Attach to all the given tmux targets in a tiled layout").Bool()
+	timings         = kingpin.Flag("timings", "Print the duration of every target and the critical path when done").Bool()
+	dryRun          = kingpin.Flag("dry-run", "Show what would be started/stopped and check that the runners are available").Bool()
+	noNoop          = kingpin.Flag("no-noop", "Fail if a given target does nothing (unless it's marked as aggregate)").Bool()
+	prune           = kingpin.Flag("prune", "List tmux sessions started by doo which don't belong to any target (other runners aren't tracked)").Bool()
+	force           = kingpin.Flag("force", "Remove the sessions found by --prune").Bool()
+	replay          = kingpin.Flag("replay", "Run the targets of the last run again, skipping the ones which succeeded").Bool()
+	noColor         = kingpin.Flag("no-color", "Disable colors (also disabled by setting NO_COLOR)").Bool()
+	jsonOutput      = kingpin.Flag("json", "Print --list/--last (and write --log-file) as JSON").Bool()
+	order           = kingpin.Flag("order", "Print the order the targets would run in, grouped by what can run in parallel").Bool()
+	last            = kingpin.Flag("last", "Show the results of the last run").Bool()
+	run             = kingpin.Flag("run", "Define a target running the given command (can be repeated). Started when no targets are given").PlaceHolder("COMMAND").Strings()
+	runCwd          = kingpin.Flag("cwd", "Directory for the --run targets").String()
+	runListens      = kingpin.Flag("listen", "Address the --run targets listen to (can be repeated)").PlaceHolder("ADDR").Strings()
+	kill            = kingpin.Flag("kill", "Like --stop, but kill the targets right away instead of stopping them gracefully").Bool()
+	groupOutput     = kingpin.Flag("group-output", "Buffer the output of shell targets and print it when they're done").Bool()
+	strict          = kingpin.Flag("strict", "Treat warnings as errors").Bool()
+	monitor         = kingpin.Flag("monitor", "Periodically show the state of every job while running").Bool()
+	export          = kingpin.Flag("export", "Print the targets in another format (makefile)").PlaceHolder("FORMAT").Enum("makefile")
+	allowRunner     = kingpin.Flag("allow-runner", "Only allow targets using the given runner (can be repeated)").PlaceHolder("RUNNER").Strings()
+	logFile         = kingpin.Flag("log-file", "Append the starts and completions of every target to a file (as JSON lines with --json)").PlaceHolder("PATH").String()
+	pick            = kingpin.Flag("pick", "Choose the targets with fzf").Bool()
+	health          = kingpin.Flag("health", "Check the listens (and verify) of the given targets without starting them").Bool()
+	waitReady       = kingpin.Flag("wait", "Wait until the given targets listen (and pass verify) without starting them").Bool()
+	env             = kingpin.Flag("env", "Also load NAME.ENV.toml next to every NAME.toml, overriding its settings").PlaceHolder("ENV").String()
+	onComplete      = kingpin.Flag("on-complete", "Run a command after each target (with DOO_TARGET, DOO_STATUS, DOO_DURATION and DOO_ERROR set)").PlaceHolder("CMD").String()
+	createCwd       = kingpin.Flag("create-cwd", "Create missing cwd directories instead of failing").Bool()
+	stats           = kingpin.Flag("stats", "Print a summary of the loaded targets").Bool()
+	rollback        = kingpin.Flag("rollback", "Stop the targets which this run started if another one fails (targets which were already running are left alone)").Bool()
+	noJitter        = kingpin.Flag("no-jitter", "Don't randomize the delays between readiness checks").Bool()
+	preflight       = kingpin.Flag("preflight", "Check that the runners (and ssh hosts) used by the given targets are available").Bool()
+	chain           = kingpin.Flag("chain", "Run the given targets one after another in the order given").Bool()
+	overrideCommand = kingpin.Flag("command", "Run the given target with this command instead of the configured one").PlaceHolder("CMD").String()
+	withDeps        = kingpin.Flag("with-deps", "Include everything the given targets would run in --list").Bool()
+	jobs            = kingpin.Flag("jobs", "Maximum number of jobs to run at once (or auto for the number of CPUs)").String()
+	notify          = kingpin.Flag("notify", "Show a desktop notification when the run is done").Bool()
+	showDiff        = kingpin.Flag("diff", "Show which targets should be running but aren't (+) and which are running but shouldn't be (-)").Bool()
+	apply           = kingpin.Flag("apply", "Start and stop targets to resolve the differences shown by --diff").Bool()
+	tail            = kingpin.Flag("tail", "Only show the last N lines of the output of failed commands").PlaceHolder("N").Int()
+	lock            = kingpin.Flag("lock", "Don't let another doo start the same targets at the same time").Bool()
+	metricsFile     = kingpin.Flag("metrics-file", "Write metrics about the run in the Prometheus text format").PlaceHolder("PATH").String()
+	verboseFlag     = kingpin.Flag("verbose", "Print the commands run by the runners (without the values of environment variables)").Bool()
+	matrix          = kingpin.Flag("matrix", "Run an instance of the targets for every value, with ${VAR} replaced (can be repeated)").PlaceHolder("VAR=A,B,C").Strings()
+	why             = kingpin.Flag("why", "Explain why a target would be started/stopped by the given targets").PlaceHolder("TARGET").String()
+	targets         = kingpin.Arg("target", "Target to start/stop. Arguments after -- are appended to its command").Strings()
+)
+
+func (d *doo) configDirectories() []string {
+	var res []string
+
+	addPath := func(path string) {
+		if fi, err := os.Stat(path); err == nil {
+			if fi.Mode().IsDir() {
+				res = append(res, path)
+			}
+		}
+	}
+
+	// ~/.config/doo
+	if len(d.homeDir) > 0 {
+		addPath(filepath.Join(d.homeDir, ".config", "doo"))
+	}
+
+	// .doo in all parent directories
+	if dir, err := os.Getwd(); err == nil {
+		for true {
+			addPath(filepath.Join(dir, ".doo"))
+			newDir := filepath.Dir(dir)
+			if newDir == dir {
+				break
+			}
+			dir = newDir
+		}
+	}
+
+	return res
+}
+
+// prune finds instances started by runners which don't belong to any target
+func (d *doo) prune(remove bool) error {
+	var names []string
+	for name := range runners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p, ok := runners[name].(pruner)
+		if !ok {
+			continue
+		}
+
+		instances, err := p.instances()
+		if err != nil {
+			return err
+		}
+
+		for _, instance := range instances {
+			if target, ok := d.targetMap[instance]; ok && target.Runner == name {
+				continue
+			}
+
+			if remove {
+				fmt.Fprintf(d.out, "removing %s instance %s\n", name, instance)
+				if err := p.remove(instance); err != nil {
+					return err
+				}
+			} else {
+				fmt.Fprintf(d.out, "%s\t%s\n", name, instance)
+			}
+		}
+	}
+	return nil
+}
+
+// stateDir returns the directory where doo keeps its state, creating it if
+// needed.
+func (d *doo) stateDir() (string, error) {
+	var dir string
+	if xdg := os.Getenv("XDG_STATE_HOME"); len(xdg) > 0 {
+		dir = filepath.Join(xdg, "doo")
+	} else if xdg := os.Getenv("XDG_CACHE_HOME"); len(xdg) > 0 {
+		dir = filepath.Join(xdg, "doo")
+	} else if len(d.homeDir) > 0 {
+		dir = filepath.Join(d.homeDir, ".local", "state", "doo")
+	} else {
+		return "", fmt.Errorf("could not find state directory")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// matchTargets finds the targets matching a name, an alias or a glob pattern
+func (d *doo) matchTargets(q string) ([]string, error) {
+	if _, ok := d.targetMap[q]; ok {
+		return []string{q}, nil
+	}
+
+	if target, ok := d.aliasMap[q]; ok {
+		return []string{target.Name}, nil
+	}
+
+	g, err := glob.Compile(q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pattern '%s': %s", q, err)
+	}
+
+	var res []string
+	for _, target := range d.targets {
+		// Manual targets have to be named explicitly
+		if g.Match(target.Name) && !target.Manual {
+			res = append(res, target.Name)
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no target matched: %s%s", q, d.suggest(q))
+	}
+	return res, nil
+}
+
+func (d *doo) expandTargets(query []string) ([]string, error) {
+	var res []string
+
+	for _, q := range query {
+		names, err := d.matchTargets(q)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, names...)
+	}
+
+	return res, nil
+}
+
+// pickTargets lets the user choose targets with fzf. The query is used as the
+// initial search. Returns nothing if the user aborts.
+func (d *doo) pickTargets(query []string) ([]string, error) {
+	if _, err := exec.LookPath("fzf"); err != nil {
+		return nil, fmt.Errorf("--pick requires fzf: %s", err)
+	}
+
+	var input strings.Builder
+	for _, target := range d.targets {
+		summary := strings.SplitN(strings.TrimSpace(target.Command), "\n", 2)[0]
+		fmt.Fprintf(&input, "%s\t%s\n", target.Name, summary)
+	}
+
+	cmd := exec.Command("fzf", "--multi", "--delimiter", "\t", "--query", strings.Join(query, " "))
+	cmd.Stdin = strings.NewReader(input.String())
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && (exitErr.ExitCode() == 1 || exitErr.ExitCode() == 130) {
+		// No match or aborted
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if name := strings.SplitN(line, "\t", 2)[0]; len(name) > 0 {
+			res = append(res, name)
+		}
+	}
+	return res, nil
+}
+
+// expandInvokes expands the patterns of invokes. They have already been
+// checked by validateTargets.
+func (d *doo) expandInvokes(patterns []string) []string {
+	var res []string
+	for _, pattern := range patterns {
+		names, _ := d.matchTargets(pattern)
+		res = append(res, names...)
+	}
+	return res
+}
+
+// expandLoadPattern finds the files matching a --load pattern. An existing
+// file is loaded as it is, even if its name looks like a pattern. It's an
+// error if nothing matches so that a typo doesn't silently load nothing.
+func expandLoadPattern(pattern string) ([]string, error) {
+	files := []string{pattern}
+	if _, err := os.Stat(pattern); err != nil {
+		files, err = filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %s", pattern, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no config file matched: %s", pattern)
+		}
+	}
+	var res []string
+	for _, fpath := range files {
+		if fpath != pattern && isOverlayFile(fpath) {
+			continue
+		}
+		res = append(res, fpath)
+		if fi, err := os.Stat(fpath); err != nil {
+			return nil, err
+		} else if fi.IsDir() {
+			return nil, fmt.Errorf("%s is a directory, not a config file", fpath)
+		}
+	}
+	return res, nil
+}
+
+// loadConfigs loads the config files found in the config directories,
+// followed by the extra files given.
+func (d *doo) loadConfigs(extra []string) error {
+	var loadConfig = func(fpath string) error {
+		if err := d.loadConfigFile(fpath); err != nil {
+			return fmt.Errorf("failed to parse %s: %s", fpath, err.Error())
+		}
+		return nil
+	}
+
+	for _, dir := range d.configDirectories() {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			// e.g. a directory we don't have permission to read
+			d.warnings = append(d.warnings, fmt.Sprintf("skipping %s: %s", dir, err))
+			continue
+		}
+		for _, file := range files {
+			if isConfigFile(file.Name()) && !isOverlayFile(filepath.Join(dir, file.Name())) {
+				if err := loadConfig(filepath.Join(dir, file.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, pattern := range extra {
+		files, err := expandLoadPattern(pattern)
+		if err != nil {
+			return err
+		}
+		for _, fpath := range files {
+			if err := loadConfig(fpath); err != nil {
+				return err
+			}
+		}
 	}
-}
 
-func bold(s string) string {
-	return fmt.Sprintf("\x1b[1m%s\x1b[0m", s)
+	return d.resolveReferences()
 }
 
-func (d *doo) logStart(job *Job) {
-	if job.isNoop() {
-		return
+// addRunTargets defines a target for each command given with --run. They're
+// named run (or run-1, run-2, ... if there are several).
+func (d *doo) addRunTargets(commands []string, cwd string, listens []string) ([]string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
 	}
-	action := "starting"
-	if job.mode == TargetStop {
-		action = "stopping"
+	if len(cwd) > 0 {
+		cwd = d.expandPath(cwd, wd)
 	}
-	fmt.Printf(">> %s %s\n", bold(job.target.Name), action)
-}
 
-func (d *doo) logComplete(job *Job) {
-	if job.isNoop() {
-		return
+	conf := &dooConfig{Path: "(command line)"}
+	var names []string
+	for i, command := range commands {
+		name := "run"
+		if len(commands) > 1 {
+			name = fmt.Sprintf("run-%d", i+1)
+		}
+		target := &Target{
+			Name:    name,
+			Command: command,
+			Cwd:     cwd,
+			Runner:  "shell",
+			Listens: listens,
+			config:  conf,
+		}
+		conf.Targets = append(conf.Targets, target)
+		names = append(names, name)
 	}
-	dur := job.completedAt.Sub(*job.startedAt)
-	fmt.Printf("<< %s completed in %s\n", bold(job.target.Name), prettyDuration(dur))
-	if job.err != nil {
-		fmt.Printf("!! %s failed: %v\n", bold(job.target.Name), job.err)
+	d.targets = append(d.targets, conf.Targets...)
+	return names, nil
+}
+
+func printErrors(l *log.Logger, errs []string) {
+	l.Printf("found %d error(s):", len(errs))
+	for _, err := range errs {
+		l.Printf("- %s", err)
 	}
 }
 
-func (d *doo) runAllJobs() {
-	for true {
-		if d.didError {
+func main() {
+	kingpin.Version(version)
+
+	// Arguments after "--" are passed on to the target
+	args := os.Args[1:]
+	var extraArgs []string
+	for i, arg := range args {
+		if arg == "--" {
+			extraArgs = args[i+1:]
+			args = args[:i]
 			break
 		}
+	}
+	kingpin.MustParse(kingpin.CommandLine.Parse(args))
 
-		if d.hasCompleted() {
-			break
-		}
+	d := newDoo()
+	var l = log.New(os.Stderr, "", 0)
 
-		job := d.nextJob()
-		if job != nil {
-			d.startJob(job)
-		} else if d.hasRunningJobs() {
-			job = <-d.completion
-			d.didComplete(job)
+	// Ctrl-C cancels the jobs instead of killing doo so that it can still
+	// report (and roll back) the run. Another one kills it right away.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	go func() {
+		<-ctx.Done()
+		stopSignals()
+	}()
+	d.ctx = ctx
+
+	d.ignoreDependencies = *only || *noDeps
+	d.dryRun = *dryRun
+	if *kill {
+		*stop = true
+		d.kill = true
+	}
+	d.useColor = !*noColor && len(os.Getenv("NO_COLOR")) == 0
+	d.env = *env
+	if *noJitter {
+		backoffJitter = 0
+	}
+	if *tail < 0 {
+		l.Fatalf("invalid --tail: %d", *tail)
+	}
+	outputTail = *tail
+	verbose = *verboseFlag
+	d.createCwd = *createCwd
+	d.lockAll = *lock
+	if len(*jobs) > 0 {
+		if *jobs == "auto" {
+			d.maxJobs = runtime.NumCPU()
+		} else if n, err := strconv.Atoi(*jobs); err == nil && n > 0 {
+			d.maxJobs = n
 		} else {
-			break
+			l.Fatalf("invalid --jobs: %s (expected a positive number or auto)", *jobs)
 		}
 	}
-}
-
-var (
-	stop    = kingpin.Flag("stop", "Stop specified targets").Bool()
-	list    = kingpin.Flag("list", "List available targets").Bool()
-	load    = kingpin.Flag("load", "Load configuration file").PlaceHolder("CONFIG").ExistingFiles()
-	only    = kingpin.Flag("only", "Ignore dependencies").Bool()
-	pwd     = kingpin.Flag("pwd", "Prints the directory for the target").Bool()
-	targets = kingpin.Arg("target", "Target to start/stop").Strings()
-)
-
-func (d *doo) configDirectories() []string {
-	var res []string
-
-	addPath := func(path string) {
-		if fi, err := os.Stat(path); err == nil {
-			if fi.Mode().IsDir() {
-				res = append(res, path)
+	if len(*allowRunner) > 0 {
+		d.allowedRunners = make(map[string]bool)
+		for _, runner := range *allowRunner {
+			if !isValidRunner(runner) {
+				l.Fatalf("invalid runner: %s", runner)
 			}
+			d.allowedRunners[runner] = true
 		}
 	}
-
-	// ~/.config/doo
-	if len(d.homeDir) > 0 {
-		addPath(filepath.Join(d.homeDir, ".config", "doo"))
-	}
-
-	// .doo in all parent directories
-	if dir, err := os.Getwd(); err == nil {
-		for true {
-			addPath(filepath.Join(dir, ".doo"))
-			newDir := filepath.Dir(dir)
-			if newDir == dir {
-				break
+	if len(*onComplete) > 0 {
+		d.onComplete = func(job *Job) {
+			if job.isNoop() || d.dryRun {
+				return
+			}
+			if err := runCompletionHook(*onComplete, job); err != nil {
+				l.Printf("warning: --on-complete failed for %s: %s", job.target.Name, err)
 			}
-			dir = newDir
 		}
 	}
+	if len(*logFile) > 0 {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			l.Fatalln(err)
+		}
+		defer f.Close()
+		d.events = &eventLog{w: &syncWriter{w: f}, json: *jsonOutput}
+	}
+	if *monitor {
+		d.monitorTick = time.NewTicker(2 * time.Second).C
+	}
+	shell := shellRunner{}
+	if *groupOutput {
+		shell.out = d.out
+	}
+	if dir, err := d.stateDir(); err == nil {
+		// Lets --stop and --kill find the commands of shell targets
+		shell.pidDir = filepath.Join(dir, "pids")
+	}
+	runners["shell"] = shell
 
-	return res
-}
-
-func (d *doo) expandTargets(query []string) ([]string, error) {
-	var res []string
+	if err := d.loadConfigs(*load); err != nil {
+		l.Fatalln(err)
+	}
 
-	for _, q := range query {
-		if _, ok := d.targetMap[q]; ok {
-			res = append(res, q)
-		} else {
-			g, err := glob.Compile(q)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse pattern '%s': %s", q, err)
-			}
-			matchedAnything := false
-			for _, target := range d.targets {
-				if g.Match(target.Name) {
-					matchedAnything = true
-					res = append(res, target.Name)
-				}
-			}
-			if !matchedAnything {
-				return nil, fmt.Errorf("no target matched: %s", q)
-			}
+	if len(*run) > 0 {
+		names, err := d.addRunTargets(*run, *runCwd, *runListens)
+		if err != nil {
+			l.Fatalln(err)
+		}
+		if len(*targets) == 0 {
+			*targets = names
 		}
 	}
 
-	return res, nil
-}
+	var errs []string
+	d.validateTargets(&errs)
 
-func main() {
-	kingpin.Parse()
+	if len(errs) > 0 {
+		printErrors(l, errs)
+		os.Exit(1)
+	}
 
-	d := newDoo()
-	var l = log.New(os.Stderr, "", 0)
+	if *strict && len(d.warnings) > 0 {
+		printErrors(l, d.warnings)
+		os.Exit(1)
+	}
+	for _, warning := range d.warnings {
+		l.Printf("warning: %s", warning)
+	}
 
-	d.ignoreDependencies = *only
+	if *stats {
+		d.printStats()
+		return
+	}
 
-	var loadConfig = func(fpath string) {
-		if err := d.loadConfigFile(fpath); err != nil {
-			l.Fatalf("failed to parse %s: %s", fpath, err.Error())
+	if *prune {
+		if err := d.prune(*force); err != nil {
+			l.Fatalln(err)
 		}
+		return
 	}
 
-	for _, dir := range d.configDirectories() {
-		files, err := ioutil.ReadDir(dir)
+	if *last {
+		report, err := d.loadReport()
 		if err != nil {
-			// shouldn't happen because dooDirectories already checks it
-			l.Fatalln(err)
+			l.Fatalf("no previous run: %s", err)
 		}
-		for _, file := range files {
-			if strings.HasSuffix(file.Name(), ".toml") {
-				loadConfig(filepath.Join(dir, file.Name()))
-			}
+		if *jsonOutput {
+			err = report.writeJSON(d.out)
+		} else {
+			report.print(d.out)
+		}
+		if err != nil {
+			l.Fatalln(err)
 		}
+		return
 	}
 
-	for _, fpath := range *load {
-		loadConfig(fpath)
+	var lastReport *runReport
+	if *replay {
+		var err error
+		lastReport, err = d.loadReport()
+		if err != nil {
+			l.Fatalf("no run to replay: %s", err)
+		}
+		if !lastReport.hasFailed() {
+			fmt.Fprintf(d.out, "last run succeeded. nothing to do.\n")
+			return
+		}
+		*targets = lastReport.Targets
+		*stop = lastReport.Stop
 	}
 
-	var errs []string
-	d.validateTargets(&errs)
-
-	if len(errs) > 0 {
-		l.Printf("found %d error(s):", len(errs))
-		for _, err := range errs {
-			l.Printf("- %s", err)
+	if *pick {
+		names, err := d.pickTargets(*targets)
+		if err != nil {
+			l.Fatalln(err)
 		}
-		os.Exit(1)
+		if len(names) == 0 {
+			return
+		}
+		*targets = names
 	}
 
 	expandedTargets, err := d.expandTargets(*targets)
@@ -491,43 +2547,307 @@ func main() {
 	if *pwd {
 		for _, targetName := range expandedTargets {
 			target := d.targetMap[targetName]
-			fmt.Printf("%s\n", target.Cwd)
+			fmt.Fprintf(d.out, "%s\n", target.Cwd)
 		}
 		return
 	}
 
+	if *export == "makefile" {
+		writeMakefile(d.out, d.targets)
+		return
+	}
+
 	if *list {
-		if len(*targets) == 0 {
-			for _, target := range d.targets {
-				fmt.Printf("%s\n", target.Name)
+		listed := d.targets
+		if len(*targets) > 0 && *withDeps {
+			listed = nil
+			for _, targetName := range d.plannedTargets(expandedTargets, *stop) {
+				listed = append(listed, d.targetMap[targetName])
 			}
-		} else {
+		} else if len(*targets) > 0 {
+			listed = nil
 			for _, targetName := range expandedTargets {
-				fmt.Printf("%s\n", targetName)
+				listed = append(listed, d.targetMap[targetName])
+			}
+		}
+
+		if *jsonOutput {
+			if err := writeTargetsJSON(d.out, listed); err != nil {
+				l.Fatalln(err)
+			}
+			return
+		}
+
+		for _, target := range listed {
+			if *showSource {
+				fmt.Fprintf(d.out, "%s\t%s\n", target.Name, target.config.Path)
+			} else {
+				fmt.Fprintf(d.out, "%s\n", target.Name)
 			}
 		}
 		return
 	}
 
+	if len(expandedTargets) == 0 && len(*targets) == 0 && !*stop {
+		name, err := d.defaultTarget()
+		if err != nil {
+			l.Fatalln(err)
+		}
+		if len(name) > 0 {
+			expandedTargets, err = d.expandTargets([]string{name})
+			if err != nil {
+				l.Fatalln(err)
+			}
+		}
+	}
+
 	if len(expandedTargets) == 0 {
 		l.Fatalf("no targets. nothing to do.")
 	}
 
+	if *attachAll {
+		var tmuxTargets []*Target
+		for _, name := range expandedTargets {
+			if target := d.targetMap[name]; target.Runner == "tmux" {
+				tmuxTargets = append(tmuxTargets, target)
+			}
+		}
+		if len(tmuxTargets) == 0 {
+			l.Fatalln("no tmux targets to attach to")
+		}
+		if _, ok := d.targetMap[attachAllSession]; ok {
+			l.Fatalf("--attach-all uses the tmux session %s, which is also the name of a target", attachAllSession)
+		}
+		if err := tmuxAttachAll(tmuxTargets); err != nil {
+			l.Fatalln(err)
+		}
+		return
+	}
+
+	if *waitReady {
+		if !d.waitReady(expandedTargets) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *health {
+		if !d.checkHealth(expandedTargets) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(*why) > 0 {
+		if _, ok := d.targetMap[*why]; !ok {
+			l.Fatalf("unknown target: %s", *why)
+		}
+		paths := d.explainTarget(expandedTargets, *why, *stop)
+		if len(paths) == 0 {
+			l.Fatalf("%s would not run", *why)
+		}
+		for _, path := range paths {
+			fmt.Fprintf(d.out, "%s\n", path)
+		}
+		return
+	}
+
+	if *showDiff {
+		result, err := d.diffTargets(expandedTargets)
+		if err != nil {
+			l.Fatalln(err)
+		}
+		for _, name := range result.missing {
+			fmt.Fprintf(d.out, "+ %s\n", name)
+		}
+		for _, name := range result.extra {
+			fmt.Fprintf(d.out, "- %s\n", name)
+		}
+		if *apply && !d.applyDiff(expandedTargets, result) {
+			os.Exit(1)
+		}
+		return
+	} else if *apply {
+		l.Fatalln("--apply can only be used with --diff")
+	}
+
+	for _, name := range expandedTargets {
+		if d.targetMap[name].Disabled {
+			if *strict {
+				l.Fatalf("%s is disabled", name)
+			}
+			l.Printf("warning: %s is disabled", name)
+		}
+		if !d.targetMap[name].supportsPlatform() {
+			if *strict {
+				l.Fatalf("%s is skipped on %s", name, runtime.GOOS)
+			}
+			l.Printf("warning: %s is skipped on %s", name, runtime.GOOS)
+		}
+	}
+
+	if len(*overrideCommand) > 0 {
+		if len(expandedTargets) != 1 || *stop {
+			l.Fatalln("--command can only be given when starting a single target")
+		}
+		d.targetMap[expandedTargets[0]].Command = *overrideCommand
+	}
+
+	if len(extraArgs) > 0 {
+		if len(expandedTargets) != 1 || *stop {
+			l.Fatalln("extra arguments can only be given when starting a single target")
+		}
+		target := d.targetMap[expandedTargets[0]]
+		if target.Runner == "launchd" {
+			l.Fatalln("extra arguments are not supported by the launchd runner")
+		}
+		for _, arg := range extraArgs {
+			target.Command += " " + shellQuote(arg)
+		}
+	}
+
+	// Supervising resolves the same targets again on reload, which then
+	// applies --matrix as well
+	supervised := expandedTargets
+	if len(*matrix) > 0 {
+		expandedTargets, err = d.addMatrixTargets(expandedTargets, *matrix)
+		if err != nil {
+			l.Fatalln(err)
+		}
+	}
+
 	if *stop {
 		for _, name := range expandedTargets {
 			d.createStopJob(name)
 		}
-		d.runAllJobs()
 	} else {
 		for _, name := range expandedTargets {
 			d.createStartJob(name)
 		}
-		d.runAllJobs()
+	}
+
+	if *chain {
+		for i := 1; i < len(expandedTargets); i++ {
+			prev, next := expandedTargets[i-1], expandedTargets[i]
+			if prev == next {
+				continue
+			}
+			if d.jobs[next].isNeededBy(d.jobs[prev]) {
+				// Ordering next after prev would be a cycle
+				l.Printf("warning: can't chain %s after %s since %s needs it", next, prev, prev)
+				continue
+			}
+			addJobDependency(d.jobs[next], d.jobs[prev])
+		}
+	}
+
+	if *noNoop {
+		var errs []string
+		for _, name := range expandedTargets {
+			job := d.jobs[name]
+			if job.isNoop() && !job.target.Aggregate {
+				errs = append(errs, fmt.Sprintf("%s does nothing", name))
+			}
+		}
+		if len(errs) > 0 {
+			printErrors(l, errs)
+			os.Exit(1)
+		}
+	}
+
+	if *preflight {
+		if !d.preflight() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *order {
+		waves, leftover := d.waves()
+		for i, wave := range waves {
+			fmt.Fprintf(d.out, "%d: %s\n", i+1, strings.Join(wave, ", "))
+		}
+		if len(leftover) > 0 {
+			l.Fatalf("dependency cycle between: %s", strings.Join(leftover, ", "))
+		}
+		return
+	}
+
+	if lastReport != nil {
+		for name, job := range d.jobs {
+			// Outputs aren't saved, so targets publishing them run again
+			if lastReport.succeeded(name) && !job.target.Output {
+				d.markSatisfied(job)
+			}
+		}
+	}
+
+	if errs := d.prepareCwds(); len(errs) > 0 {
+		printErrors(l, errs)
+		os.Exit(1)
+	}
+
+	if !d.dryRun {
+		if err := d.runConfigHooks(func(h dooHooks) string { return h.Before }); err != nil {
+			l.Fatalf("before hook failed: %s", err)
+		}
+	}
+
+	runStarted := time.Now()
+	d.runAllJobs()
+
+	if !d.dryRun {
+		if err := d.runConfigHooks(func(h dooHooks) string { return h.After }); err != nil {
+			l.Printf("warning: after hook failed: %s", err)
+		}
+	}
+
+	if !d.dryRun {
+		if err := d.saveReport(d.buildReport(expandedTargets, *stop)); err != nil {
+			l.Printf("warning: failed to save report: %s", err)
+		}
+	}
+
+	if *timings {
+		d.printTimings()
+	}
+
+	if len(*metricsFile) > 0 && !d.dryRun {
+		if err := d.writeMetrics(*metricsFile, time.Since(runStarted)); err != nil {
+			l.Printf("warning: failed to write metrics: %s", err)
+		}
+	}
+
+	if *notify && !d.dryRun {
+		if err := d.notify(time.Since(runStarted)); err != nil {
+			l.Printf("warning: failed to notify: %s", err)
+		}
+	}
+
+	if d.dryRun {
+		if errs := d.checkRunners(); len(errs) > 0 {
+			printErrors(l, errs)
+			os.Exit(1)
+		}
+	}
+
+	if d.didError && *rollback && !*stop && !d.dryRun {
+		l.Println("rolling back")
+		d.rollback()
+		os.Exit(1)
 	}
 
 	if d.didError {
 		os.Exit(1)
 	} else if !d.hasCompleted() {
-		l.Fatalln("doo is deadlocked. do you have a dependency cycle?")
+		l.Println("doo is deadlocked. do you have a dependency cycle? these jobs never started:")
+		for _, line := range d.blockedJobs() {
+			l.Printf("  %s", line)
+		}
+		os.Exit(1)
+	}
+
+	if *supervise && !*stop && !d.dryRun {
+		d.supervise(ctx, l, supervised)
 	}
 }
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDoo loads and validates a config. ${dir} in it is replaced by a
+// temporary directory, which is returned as well.
+func newTestDoo(t *testing.T, config string) (*doo, string) {
+	t.Helper()
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "doo.toml")
+	config = strings.Replace(config, "${dir}", dir, -1)
+	if err := ioutil.WriteFile(fpath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDoo()
+	d.out = ioutil.Discard
+	if err := d.loadConfigFile(fpath); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.resolveReferences(); err != nil {
+		t.Fatal(err)
+	}
+	var errs []string
+	d.validateTargets(&errs)
+	if len(errs) > 0 {
+		t.Fatalf("invalid config: %v", errs)
+	}
+	return d, dir
+}
+
+// useTestTmux makes tmux use a server of its own for the test, skipping the
+// test if tmux isn't available
+func useTestTmux(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("tmux"); err != nil {
+		t.Skip("tmux isn't available")
+	}
+	t.Setenv("TMUX", "")
+	t.Setenv("TMUX_TMPDIR", t.TempDir())
+	t.Cleanup(func() {
+		exec.Command("tmux", "kill-server").Run()
+	})
+}
+
+func TestExclusiveJobsAfterBackgroundServer(t *testing.T) {
+	// The server becomes ready (and gives up the terminal) right away so the
+	// first client starts while it runs. The server exits while the first
+	// client runs, which mustn't let the second client start next to it.
+	d, dir := newTestDoo(t, `
+[[targets]]
+name = 'server'
+command = 'touch ${dir}/ready; sleep 0.3; echo server >> ${dir}/log'
+listens = ['${dir}/ready']
+
+[[targets]]
+name = 'client1'
+command = 'echo client1 >> ${dir}/log; sleep 0.6; echo client1 >> ${dir}/log'
+waitFor = ['server']
+
+[[targets]]
+name = 'client2'
+command = 'echo client2 >> ${dir}/log; sleep 0.6; echo client2 >> ${dir}/log'
+waitFor = ['server']
+`)
+
+	for _, name := range []string{"server", "client1", "client2"} {
+		d.createStartJob(name)
+	}
+	d.runAllJobs()
+
+	if d.didError || !d.hasCompleted() {
+		t.Fatalf("run didn't complete: error=%v", d.didError)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) != 5 || lines[1] != "server" {
+		t.Fatalf("first client didn't run while the server did: %v", lines)
+	}
+	if lines[0] != lines[2] || lines[3] != lines[4] {
+		t.Errorf("clients ran at the same time: %v", lines)
+	}
+}
+
+func TestDiamondWithDuplicateEdges(t *testing.T) {
+	d, _ := newTestDoo(t, `
+[[targets]]
+name = 'a'
+command = 'true'
+
+[[targets]]
+name = 'b'
+command = 'true'
+dependencies = ['a', 'a']
+
+[[targets]]
+name = 'c'
+command = 'true'
+dependencies = ['a']
+
+[[targets]]
+name = 'd'
+command = 'true'
+dependencies = ['b', 'c', 'b']
+`)
+	d.createStartJob("d")
+
+	wantCounts := map[string]int{"a": 0, "b": 1, "c": 1, "d": 2}
+	for name, want := range wantCounts {
+		if got := d.jobs[name].dependencyCount; got != want {
+			t.Errorf("dependency count of %s = %d, want %d", name, got, want)
+		}
+	}
+
+	// Complete the jobs without running them
+	complete := func(name string) {
+		job := d.jobs[name]
+		now := time.Now()
+		job.startedAt = &now
+		job.completedAt = &now
+		d.startedJobs++
+		d.didComplete(job)
+	}
+
+	complete("a")
+	if d.jobs["b"].dependencyCount != 0 || d.jobs["c"].dependencyCount != 0 || d.jobs["d"].dependencyCount != 2 {
+		t.Fatalf("unexpected dependency counts after a: b=%d c=%d d=%d",
+			d.jobs["b"].dependencyCount, d.jobs["c"].dependencyCount, d.jobs["d"].dependencyCount)
+	}
+	complete("b")
+	complete("c")
+	if got := d.jobs["d"].dependencyCount; got != 0 {
+		t.Errorf("dependency count of d = %d after its dependencies completed, want 0", got)
+	}
+	if next := d.nextJob(); next != d.jobs["d"] {
+		t.Errorf("nextJob() didn't return d")
+	}
+	complete("d")
+	if d.didError || !d.hasCompleted() {
+		t.Errorf("didError = %v, hasCompleted = %v", d.didError, d.hasCompleted())
+	}
+}
+
+func TestFailedAfterTargetDoesNotStopDependent(t *testing.T) {
+	// b can only start once slow is done, which is long after a failed
+	d, dir := newTestDoo(t, `
+[[targets]]
+name = 'a'
+command = 'exit 1'
+
+[[targets]]
+name = 'slow'
+command = 'sleep 0.2'
+
+[[targets]]
+name = 'b'
+command = 'touch ${dir}/b'
+dependencies = ['slow']
+after = ['a']
+`)
+	d.createStartJob("a")
+	d.createStartJob("b")
+	d.runAllJobs()
+
+	if _, err := os.Stat(filepath.Join(dir, "b")); err != nil {
+		t.Errorf("b didn't run after a failed: %v", err)
+	}
+	if d.jobs["b"].err != nil {
+		t.Errorf("b failed: %v", d.jobs["b"].err)
+	}
+	if !d.didError {
+		t.Errorf("the failure of a wasn't reported")
+	}
+}
+
+func TestFailedDependencyStopsRun(t *testing.T) {
+	d, _ := newTestDoo(t, `
+[[targets]]
+name = 'a'
+command = 'exit 1'
+
+[[targets]]
+name = 'b'
+command = 'true'
+dependencies = ['a']
+after = ['a']
+`)
+	d.createStartJob("b")
+	d.runAllJobs()
+
+	if !d.didError || d.jobs["b"].startedAt != nil {
+		t.Errorf("b started although its dependency failed")
+	}
+}
+
+func TestDefaultRunnerSkipsAggregateTargets(t *testing.T) {
+	d, _ := newTestDoo(t, `
+[defaults]
+runner = 'tmux'
+listens = [':8080']
+
+[[targets]]
+name = 'server'
+command = 'bin/server'
+
+[[targets]]
+name = 'all'
+dependencies = ['server']
+`)
+	if got := d.targetMap["server"].Runner; got != "tmux" {
+		t.Errorf("runner of server = %s, want tmux", got)
+	}
+	if got := d.targetMap["all"].Runner; got != "shell" {
+		t.Errorf("runner of all = %s, want shell", got)
+	}
+	if got := d.targetMap["server"].Listens; len(got) != 1 {
+		t.Errorf("listens of server = %v, want [:8080]", got)
+	}
+	if got := d.targetMap["all"].Listens; len(got) != 0 {
+		t.Errorf("listens of all = %v, want none", got)
+	}
+	if len(d.warnings) > 0 {
+		t.Errorf("warnings = %v, want none", d.warnings)
+	}
+}
+
+func TestIsNeededBy(t *testing.T) {
+	d, _ := newTestDoo(t, `
+[[targets]]
+name = 'a'
+command = 'true'
+
+[[targets]]
+name = 'b'
+command = 'true'
+dependencies = ['a']
+
+[[targets]]
+name = 'c'
+command = 'true'
+waitFor = ['b']
+`)
+	d.createStartJob("c")
+
+	a, b, c := d.jobs["a"], d.jobs["b"], d.jobs["c"]
+	if !a.isNeededBy(b) || !a.isNeededBy(c) || !b.isNeededBy(c) {
+		t.Errorf("dependencies and waits aren't followed")
+	}
+	if b.isNeededBy(a) || c.isNeededBy(a) {
+		t.Errorf("a doesn't need b or c")
+	}
+}
+
+func TestWarnForegroundListens(t *testing.T) {
+	d, _ := newTestDoo(t, `
+[[targets]]
+name = 'server'
+command = 'bin/server'
+listens = ['localhost:8080']
+
+[[targets]]
+name = 'detached'
+command = 'bin/server'
+listens = ['localhost:8081']
+detachWhenReady = true
+`)
+	if len(d.warnings) != 1 || !strings.Contains(d.warnings[0], "server runs in the foreground") {
+		t.Errorf("warnings = %v, want one for server", d.warnings)
+	}
+}
+
+func TestOnCompleteDoesNotBlockScheduler(t *testing.T) {
+	d, _ := newTestDoo(t, `
+[[targets]]
+name = 'a'
+command = 'true'
+
+[[targets]]
+name = 'b'
+command = 'true'
+dependencies = ['a']
+`)
+	bDone := make(chan bool)
+	var blocked bool
+	d.onComplete = func(job *Job) {
+		switch job.target.Name {
+		case "a":
+			// Only returns once b has completed
+			select {
+			case <-bDone:
+			case <-time.After(2 * time.Second):
+				blocked = true
+			}
+		case "b":
+			close(bDone)
+		}
+	}
+	d.createStartJob("b")
+	d.runAllJobs()
+
+	if blocked {
+		t.Errorf("b didn't run while the hook of a did")
+	}
+	if d.didError || !d.hasCompleted() {
+		t.Errorf("didError = %v, hasCompleted = %v", d.didError, d.hasCompleted())
+	}
+}
+
+func TestExpandLoadPatternLiteralPath(t *testing.T) {
+	dir := t.TempDir()
+	literal := filepath.Join(dir, "app[1].toml")
+	if err := ioutil.WriteFile(literal, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := expandLoadPattern(literal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != literal {
+		t.Errorf("files = %v, want %s", files, literal)
+	}
+
+	if _, err := expandLoadPattern(filepath.Join(dir, "missing[1].toml")); err == nil {
+		t.Errorf("missing file didn't fail")
+	}
+}
+
+func TestMatrixTargetsAreValidated(t *testing.T) {
+	d, _ := newTestDoo(t, `
+[[targets]]
+name = 'server'
+runner = 'tmux'
+command = 'bin/server --port 80${port}'
+listens = ['localhost:80${port}']
+`)
+	names, err := d.addMatrixTargets([]string{"server"}, []string{"port=80,81"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || d.targetMap["server-81"].Listens[0] != "localhost:8081" {
+		t.Errorf("unexpected instances: %v", names)
+	}
+
+	if _, err := d.addMatrixTargets([]string{"server"}, []string{"port=x"}); err == nil {
+		t.Errorf("invalid listens of an instance didn't fail")
+	}
+}
+
+func TestRollbackLeavesRunningTargetsAlone(t *testing.T) {
+	useTestTmux(t)
+
+	d, _ := newTestDoo(t, `
+[[targets]]
+name = 'db'
+runner = 'tmux'
+command = 'sleep 100'
+
+[[targets]]
+name = 'app'
+runner = 'tmux'
+command = 'sleep 100'
+invokes = ['db']
+
+[[targets]]
+name = 'fail'
+command = 'exit 1'
+dependencies = ['app']
+`)
+	if err := exec.Command("tmux", "new-session", "-d", "-s", "db").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.createStartJob("fail")
+	d.runAllJobs()
+	if !d.didError {
+		t.Fatalf("run didn't fail")
+	}
+	d.rollback()
+
+	if !tmuxSessionExists(d.targetMap["db"]) {
+		t.Errorf("db was running before the run, but rollback stopped it")
+	}
+	if tmuxSessionExists(d.targetMap["app"]) {
+		t.Errorf("app was started by the run, but rollback didn't stop it")
+	}
+}
+
+func TestRunnerLimits(t *testing.T) {
+	useTestTmux(t)
+	d, _ := newTestDoo(t, `
+[defaults]
+runnerLimits = { tmux = 1 }
+
+[[targets]]
+name = 'a'
+runner = 'tmux'
+command = 'sleep 100'
+
+[[targets]]
+name = 'b'
+runner = 'tmux'
+command = 'sleep 100'
+`)
+	d.createStartJob("a")
+	d.createStartJob("b")
+
+	first := d.nextJob()
+	d.startJob(first)
+	if next := d.nextJob(); next != nil {
+		t.Fatalf("%s started while %s was in flight", next.target.Name, first.target.Name)
+	}
+	d.didComplete(<-d.completion)
+	if next := d.nextJob(); next == nil || next == first {
+		t.Fatalf("the other job didn't start once %s completed", first.target.Name)
+	}
+	if got := d.runnerJobs["tmux"]; got != 0 {
+		t.Errorf("%d tmux jobs in flight, want 0", got)
+	}
+}
+
+func TestDependencyOnFinishedJob(t *testing.T) {
+	ok := &Job{done: true}
+	failed := &Job{done: true, err: errors.New("failed")}
+	unhandled := &Job{err: errors.New("failed")}
+
+	job := &Job{}
+	addJobDependency(job, ok)
+	if job.dependencyCount != 0 {
+		t.Errorf("dependency on a succeeded job wasn't skipped")
+	}
+	addJobDependency(job, failed)
+	if job.dependencyCount != 1 {
+		t.Errorf("dependency on a failed job was skipped")
+	}
+	// The scheduler hasn't handled the completion yet, so it will decrement
+	addJobDependency(job, unhandled)
+	if job.dependencyCount != 2 || len(unhandled.dependentJobs) != 1 {
+		t.Errorf("dependency on a job which isn't done wasn't added")
+	}
+}
+
+func TestJobStatus(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		job  *Job
+		want string
+	}{
+		{&Job{}, statusPending},
+		{&Job{startedAt: &now}, statusRunning},
+		// Completed by the job, but not yet handled by the scheduler
+		{&Job{startedAt: &now, completedAt: &now, err: errors.New("failed")}, statusRunning},
+		{&Job{startedAt: &now, completedAt: &now, done: true}, statusOK},
+		{&Job{startedAt: &now, completedAt: &now, err: errors.New("failed"), done: true}, statusFailed},
+	}
+	for i, test := range tests {
+		if got := test.job.status(); got != test.want {
+			t.Errorf("%d: status() = %s, want %s", i, got, test.want)
+		}
+	}
+}
+
+func TestDryRunWithOutputs(t *testing.T) {
+	d, _ := newTestDoo(t, `
+[[targets]]
+name = 'build'
+command = 'echo tag=1'
+output = true
+
+[[targets]]
+name = 'deploy'
+command = 'echo ${outputs.build.tag}'
+dependencies = ['build']
+`)
+	d.dryRun = true
+	d.createStartJob("deploy")
+	d.runAllJobs()
+
+	if d.didError || !d.hasCompleted() {
+		t.Errorf("dry run failed: %v", d.jobs["deploy"].err)
+	}
+}
+
+func TestPrepareCwds(t *testing.T) {
+	d, dir := newTestDoo(t, `
+[[targets]]
+name = 'a'
+command = 'true'
+cwd = '${dir}/a'
+
+[[targets]]
+name = 'b'
+command = 'true'
+cwd = '${dir}/b'
+dependencies = ['a']
+invokes = ['c']
+
+[[targets]]
+name = 'c'
+command = 'true'
+cwd = '${dir}/c'
+`)
+	d.createStartJob("b")
+
+	want := []string{
+		"a: non-existent cwd: " + filepath.Join(dir, "a"),
+		"b: non-existent cwd: " + filepath.Join(dir, "b"),
+		"c: non-existent cwd: " + filepath.Join(dir, "c"),
+	}
+	if errs := d.prepareCwds(); !reflect.DeepEqual(errs, want) {
+		t.Errorf("prepareCwds() = %v, want %v", errs, want)
+	}
+
+	d.createCwd = true
+	if errs := d.prepareCwds(); len(errs) > 0 {
+		t.Errorf("prepareCwds() with createCwd = %v", errs)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "c")); err != nil || !fi.IsDir() {
+		t.Errorf("cwd of the invoked target wasn't created")
+	}
+}
+
+func TestStopMutualInvokes(t *testing.T) {
+	d, _ := newTestDoo(t, `
+[[targets]]
+name = 'a'
+command = 'true'
+invokes = ['b']
+
+[[targets]]
+name = 'b'
+command = 'true'
+invokes = ['c', 'b']
+
+[[targets]]
+name = 'c'
+command = 'true'
+invokes = ['a']
+`)
+	d.createStopJob("a")
+	d.runAllJobs()
+
+	if d.didError || !d.hasCompleted() {
+		t.Errorf("stopping targets invoking each other didn't complete: %v", d.blockedJobs())
+	}
+}
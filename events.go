@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// An eventLog records what happens during a run (see --log-file)
+type eventLog struct {
+	w    io.Writer
+	json bool
+}
+
+type event struct {
+	Time     time.Time     `json:"time"`
+	Event    string        `json:"event"`
+	Target   string        `json:"target"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func (d *doo) logEvent(job *Job, name string) {
+	if d.events == nil {
+		return
+	}
+
+	ev := event{Time: time.Now(), Event: name, Target: job.target.Name}
+	if job.completedAt != nil {
+		ev.Time = *job.completedAt
+		ev.Duration = job.duration()
+	}
+	if job.err != nil {
+		ev.Error = job.err.Error()
+	}
+
+	if d.events.json {
+		data, err := json.Marshal(ev)
+		if err == nil {
+			fmt.Fprintf(d.events.w, "%s\n", data)
+		}
+		return
+	}
+
+	line := fmt.Sprintf("%s %s %s", ev.Time.Format(time.RFC3339Nano), ev.Event, ev.Target)
+	if ev.Duration > 0 {
+		line += " " + prettyDuration(ev.Duration)
+	}
+	if len(ev.Error) > 0 {
+		line += ": " + ev.Error
+	}
+	fmt.Fprintf(d.events.w, "%s\n", line)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// makeEscape escapes a string for use in a Makefile recipe
+func makeEscape(str string) string {
+	return strings.Replace(str, "$", "$$", -1)
+}
+
+// writeMakefile writes a Makefile with a phony rule for every target. Things
+// make can't express (invokes, listens, other runners) are added as comments.
+func writeMakefile(w io.Writer, targets []*Target) {
+	var names []string
+	for _, t := range targets {
+		names = append(names, t.Name)
+	}
+
+	fmt.Fprintf(w, "# Generated by doo %s\n", version)
+	fmt.Fprintf(w, "SHELL := bash\n")
+	fmt.Fprintf(w, ".ONESHELL:\n")
+	fmt.Fprintf(w, ".PHONY: %s\n", strings.Join(names, " "))
+
+	for _, t := range targets {
+		fmt.Fprintf(w, "\n# From %s\n", t.config.Path)
+		if t.Runner != "shell" {
+			fmt.Fprintf(w, "# runner: %s (run by doo, not make)\n", t.Runner)
+		}
+		if len(t.Invokes) > 0 {
+			fmt.Fprintf(w, "# invokes: %s\n", strings.Join(t.Invokes, " "))
+		}
+		if len(t.InvokesOnFailure) > 0 {
+			fmt.Fprintf(w, "# invokes on failure: %s\n", strings.Join(t.InvokesOnFailure, " "))
+		}
+		if len(t.WaitFor) > 0 {
+			fmt.Fprintf(w, "# waits for: %s\n", strings.Join(t.WaitFor, " "))
+		}
+		if len(t.Listens) > 0 {
+			fmt.Fprintf(w, "# listens: %s\n", strings.Join(t.Listens, " "))
+		}
+
+		fmt.Fprintf(w, "%s:", t.Name)
+		for _, dep := range t.Dependencies {
+			fmt.Fprintf(w, " %s", dep)
+		}
+		fmt.Fprintf(w, "\n")
+
+		if t.Runner != "shell" || len(t.Command) == 0 {
+			continue
+		}
+
+		var keys []string
+		for key := range t.Env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "\texport %s=%s\n", key, makeEscape(shellQuote(t.Env[key])))
+		}
+		if len(t.Cwd) > 0 {
+			fmt.Fprintf(w, "\tcd %s\n", makeEscape(shellQuote(t.Cwd)))
+		}
+		for _, line := range strings.Split(strings.TrimRight(t.Command, "\n"), "\n") {
+			fmt.Fprintf(w, "\t%s\n", makeEscape(line))
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// limitCommand makes a bash command apply the resource limits of the target
+// before it runs the actual command, so that nothing it starts escapes them
+func limitCommand(cmd *exec.Cmd, t *Target) error {
+	var prefix string
+	if len(t.MemoryLimit) > 0 {
+		size, err := parseSize(t.MemoryLimit)
+		if err != nil {
+			return err
+		}
+		// ulimit counts in kilobytes
+		prefix += fmt.Sprintf("ulimit -v %d && ", size/1024)
+	}
+	if t.OpenFiles > 0 {
+		prefix += fmt.Sprintf("ulimit -n %d && ", t.OpenFiles)
+	}
+	// The command is the last argument to bash
+	cmd.Args[len(cmd.Args)-1] = prefix + cmd.Args[len(cmd.Args)-1]
+
+	if t.Nice != 0 {
+		// nice adjusts the niceness of doo while Nice is absolute. The
+		// syscall returns 20-nice on Linux.
+		prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+		if err != nil {
+			return err
+		}
+		adjustment := t.Nice - (20 - prio)
+		if adjustment != 0 {
+			path, err := exec.LookPath("nice")
+			if err != nil {
+				return err
+			}
+			cmd.Path = path
+			cmd.Args = append([]string{"nice", "-n", strconv.Itoa(adjustment)}, cmd.Args...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+)
+
+var limitsWarning sync.Once
+
+func limitCommand(cmd *exec.Cmd, t *Target) error {
+	limitsWarning.Do(func() {
+		fmt.Fprintf(os.Stderr, "warning: resource limits are not supported on %s\n", runtime.GOOS)
+	})
+	return nil
+}
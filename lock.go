@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockTarget takes a lock on starting the target so that another doo can't
+// start it at the same time. The lock file holds the PID of the owner. Returns
+// a function which releases the lock.
+func (d *doo) lockTarget(t *Target) (func(), error) {
+	dir, err := d.stateDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, "locks")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	fpath := filepath.Join(dir, strings.Replace(t.Name, "/", "_", -1)+".lock")
+	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if err == syscall.EWOULDBLOCK {
+			owner, _ := ioutil.ReadAll(f)
+			return nil, fmt.Errorf("%s is already being started by PID %s", t.Name, strings.TrimSpace(string(owner)))
+		}
+		return nil, err
+	}
+
+	// The file is never removed since another doo might be waiting to lock it
+	f.Truncate(0)
+	f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// runLocked runs the job, holding the lock of the target while starting it if
+// it (or --lock) asks for it
+func (d *doo) runLocked(ctx context.Context, job *Job, ready func()) error {
+	if job.mode != TargetStart || !job.target.Lock && !d.lockAll {
+		return runJob(ctx, job, ready)
+	}
+
+	unlock, err := d.lockTarget(job.target)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return runJob(ctx, job, ready)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// promLabel escapes a label value for the Prometheus text format
+func promLabel(str string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(str)
+}
+
+// writeMetrics writes metrics about the run in the Prometheus text format to
+// fpath (see --metrics-file). The file is replaced atomically so the
+// node_exporter never reads a partial file.
+func (d *doo) writeMetrics(fpath string, dur time.Duration) error {
+	var names []string
+	for name := range d.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	counts := make(map[string]int)
+
+	fmt.Fprintf(&buf, "# HELP doo_target_duration_seconds How long the target took.\n")
+	fmt.Fprintf(&buf, "# TYPE doo_target_duration_seconds gauge\n")
+	for _, name := range names {
+		job := d.jobs[name]
+		counts[job.status()]++
+		if job.done && !job.isNoop() {
+			fmt.Fprintf(&buf, "doo_target_duration_seconds{target=\"%s\"} %g\n", promLabel(name), job.duration().Seconds())
+		}
+	}
+
+	fmt.Fprintf(&buf, "# HELP doo_target_success Whether the target succeeded (1) or failed (0).\n")
+	fmt.Fprintf(&buf, "# TYPE doo_target_success gauge\n")
+	for _, name := range names {
+		job := d.jobs[name]
+		if !job.done {
+			continue
+		}
+		success := 1
+		if job.err != nil {
+			success = 0
+		}
+		fmt.Fprintf(&buf, "doo_target_success{target=\"%s\"} %d\n", promLabel(name), success)
+	}
+
+	fmt.Fprintf(&buf, "# HELP doo_jobs_total Jobs in the run by status.\n")
+	fmt.Fprintf(&buf, "# TYPE doo_jobs_total counter\n")
+	for _, status := range []string{statusOK, statusFailed, statusRunning, statusPending} {
+		fmt.Fprintf(&buf, "doo_jobs_total{status=\"%s\"} %d\n", status, counts[status])
+	}
+
+	fmt.Fprintf(&buf, "# HELP doo_run_duration_seconds How long the run took.\n")
+	fmt.Fprintf(&buf, "# TYPE doo_run_duration_seconds gauge\n")
+	fmt.Fprintf(&buf, "doo_run_duration_seconds %g\n", dur.Seconds())
+
+	fmt.Fprintf(&buf, "# HELP doo_run_timestamp_seconds When the run finished.\n")
+	fmt.Fprintf(&buf, "# TYPE doo_run_timestamp_seconds gauge\n")
+	fmt.Fprintf(&buf, "doo_run_timestamp_seconds %d\n", time.Now().Unix())
+
+	tmp := fpath + ".doo-tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fpath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
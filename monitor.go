@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var statusColors = map[string]string{
+	statusOK:      colors["green"],
+	statusFailed:  colors["red"],
+	statusRunning: colors["yellow"],
+	statusPending: "2", // dim
+}
+
+// printMonitor shows the state of every job. It's called periodically by
+// runAllJobs with --monitor.
+func (d *doo) printMonitor(now time.Time) {
+	byStatus := make(map[string][]*Job)
+	for _, job := range d.jobs {
+		status := job.status()
+		byStatus[status] = append(byStatus[status], job)
+	}
+
+	var lines []string
+	lines = append(lines, fmt.Sprintf("== %d running, %d pending, %d done, %d failed",
+		len(byStatus[statusRunning]), len(byStatus[statusPending]), len(byStatus[statusOK]), len(byStatus[statusFailed])))
+
+	for _, status := range []string{statusRunning, statusPending, statusFailed, statusOK} {
+		jobs := byStatus[status]
+		sort.Slice(jobs, func(i, j int) bool {
+			return jobs[i].target.Name < jobs[j].target.Name
+		})
+
+		for _, job := range jobs {
+			label := status
+			if d.useColor {
+				label = fmt.Sprintf("\x1b[%sm%-7s\x1b[0m", statusColors[status], status)
+			}
+			line := fmt.Sprintf("   %-7s %s", label, job.target.Name)
+			if status == statusRunning {
+				line += fmt.Sprintf(" (%s)", prettyDuration(now.Sub(*job.startedAt)))
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	// One write so it isn't mixed up with other output
+	fmt.Fprintf(d.out, "%s\n", strings.Join(lines, "\n"))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notify shows a desktop notification summarizing the run (see --notify)
+func (d *doo) notify(dur time.Duration) error {
+	var failed []string
+	for name, job := range d.jobs {
+		if job.err != nil {
+			failed = append(failed, name)
+		}
+	}
+
+	title := "doo succeeded"
+	message := fmt.Sprintf("%d jobs completed in %s", d.completedJobs, prettyDuration(dur))
+	if len(failed) > 0 {
+		title = "doo failed"
+		message = fmt.Sprintf("%d of %d jobs failed after %s", len(failed), len(d.jobs), prettyDuration(dur))
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", strconv.Quote(message), strconv.Quote(title))
+		if len(failed) > 0 {
+			script += ` sound name "Basso"`
+		}
+		cmd = exec.Command("osascript", "-e", script)
+	case "linux":
+		urgency := "normal"
+		if len(failed) > 0 {
+			urgency = "critical"
+		}
+		cmd = exec.Command("notify-send", "--urgency", urgency, "--app-name", "doo", title, message)
+	default:
+		return fmt.Errorf("notifications aren't supported on %s", runtime.GOOS)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil && len(out) > 0 {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// outputPattern matches ${outputs.NAME} and ${outputs.NAME.KEY}
+var outputPattern = regexp.MustCompile(`\$\{outputs\.([^.}]+)(?:\.([^}]+))?\}`)
+
+// parseOutput turns the stdout of a target into its outputs. The whole
+// (trimmed) output is stored under "" and lines of the form KEY=VALUE under
+// KEY.
+func parseOutput(stdout string) map[string]string {
+	res := map[string]string{"": strings.TrimSpace(stdout)}
+	for _, line := range strings.Split(stdout, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) == 2 && len(parts[0]) > 0 && !strings.ContainsAny(parts[0], " \t") {
+			res[parts[0]] = parts[1]
+		}
+	}
+	return res
+}
+
+// outputRefs returns the names of the targets whose outputs are used in command
+func outputRefs(command string) []string {
+	var res []string
+	for _, match := range outputPattern.FindAllStringSubmatch(command, -1) {
+		res = append(res, match[1])
+	}
+	return res
+}
+
+// expandOutputs replaces references to outputs in command with the values
+// published by targets which have completed
+func (d *doo) expandOutputs(command string) (string, error) {
+	var err error
+	res := outputPattern.ReplaceAllStringFunc(command, func(ref string) string {
+		match := outputPattern.FindStringSubmatch(ref)
+		outputs, ok := d.outputs[match[1]]
+		if !ok {
+			err = fmt.Errorf("%s hasn't published any output (was it skipped?)", match[1])
+			return ref
+		}
+		val, ok := outputs[match[2]]
+		if !ok {
+			err = fmt.Errorf("%s didn't output %s", match[1], match[2])
+			return ref
+		}
+		return val
+	})
+	return res, err
+}
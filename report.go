@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	statusOK      = "ok"
+	statusFailed  = "failed"
+	statusRunning = "running"
+	statusPending = "pending"
+)
+
+type jobReport struct {
+	Target   string        `json:"target"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// A runReport records the result of a run so that it can be shown or
+// replayed later
+type runReport struct {
+	StartedAt time.Time   `json:"startedAt"`
+	Targets   []string    `json:"targets"`
+	Stop      bool        `json:"stop"`
+	Jobs      []jobReport `json:"jobs"`
+}
+
+func (job *Job) status() string {
+	switch {
+	case job.done && job.err != nil:
+		return statusFailed
+	case job.done:
+		return statusOK
+	case job.startedAt != nil:
+		return statusRunning
+	default:
+		return statusPending
+	}
+}
+
+func (d *doo) buildReport(targets []string, stopMode bool) *runReport {
+	report := &runReport{Targets: targets, Stop: stopMode}
+	for _, job := range d.jobs {
+		if job.startedAt != nil && (report.StartedAt.IsZero() || job.startedAt.Before(report.StartedAt)) {
+			report.StartedAt = *job.startedAt
+		}
+
+		jr := jobReport{Target: job.target.Name, Status: job.status(), Duration: job.duration()}
+		if job.err != nil {
+			jr.Error = job.err.Error()
+		}
+		report.Jobs = append(report.Jobs, jr)
+	}
+
+	sort.Slice(report.Jobs, func(i, j int) bool {
+		return report.Jobs[i].Target < report.Jobs[j].Target
+	})
+	return report
+}
+
+func (r *runReport) hasFailed() bool {
+	for _, jr := range r.Jobs {
+		if jr.Status != statusOK {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *runReport) succeeded(name string) bool {
+	for _, jr := range r.Jobs {
+		if jr.Target == name {
+			return jr.Status == statusOK
+		}
+	}
+	return false
+}
+
+func (r *runReport) print(w io.Writer) {
+	verb := "start"
+	if r.Stop {
+		verb = "stop"
+	}
+	fmt.Fprintf(w, "%s %s at %s\n", verb, strings.Join(r.Targets, " "), r.StartedAt.Format(time.RFC1123))
+
+	for _, jr := range r.Jobs {
+		fmt.Fprintf(w, "  %-8s %10s  %s\n", jr.Status, prettyDuration(jr.Duration), jr.Target)
+		if len(jr.Error) > 0 {
+			fmt.Fprintf(w, "           %s\n", jr.Error)
+		}
+	}
+}
+
+func (r *runReport) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (d *doo) reportPath() (string, error) {
+	dir, err := d.stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "last-run.json"), nil
+}
+
+func (d *doo) saveReport(report *runReport) error {
+	fpath, err := d.reportPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fpath, data, 0600)
+}
+
+func (d *doo) loadReport() (*runReport, error) {
+	fpath, err := d.reportPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var report runReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
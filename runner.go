@@ -1,89 +1,518 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
 type runner interface {
-	start(*Target) error
-	stop(*Target) error
+	start(context.Context, *Target) error
+	stop(context.Context, *Target) error
+	// check returns an error if the runner can't be used on this machine
+	check() error
+}
+
+// A ListenTimeoutError is returned when a target doesn't listen to one of its
+// addresses in time
+type ListenTimeoutError struct {
+	Addr     string
+	Attempts int
+}
+
+func (e *ListenTimeoutError) Error() string {
+	return fmt.Sprintf("service didn't listen to: %s", e.Addr)
+}
+
+// errAlreadyRunning is returned by runners which found the target running
+// when starting it. The start still counts as a success.
+var errAlreadyRunning = errors.New("already running")
+
+// A RunnerError is returned when a runner fails to start/stop a target
+type RunnerError struct {
+	Runner     string
+	Target     string
+	Underlying error
+}
+
+func (e *RunnerError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Runner, e.Underlying)
+}
+
+func (e *RunnerError) Unwrap() error {
+	return e.Underlying
 }
 
 var runners = map[string]runner{
 	"shell":   shellRunner{},
+	"ssh":     sshRunner{},
 	"tmux":    tmuxRunner{},
 	"launchd": &launchdRunner{},
 }
 
+// A pruner can find and remove the instances it has started, so that
+// instances of deleted targets can be cleaned up
+type pruner interface {
+	instances() ([]string, error)
+	remove(name string) error
+}
+
+// A killer can stop a target immediately. Runners which don't implement it
+// are stopped the normal way.
+type killer interface {
+	kill(context.Context, *Target) error
+}
+
+// A liveChecker can tell whether a target it has started is still running
+type liveChecker interface {
+	alive(*Target) (bool, error)
+}
+
 func isValidRunner(str string) bool {
 	_, ok := runners[str]
 	return ok
 }
 
+// isExclusive checks if the target needs the terminal for itself
 func (t *Target) isExclusive() bool {
-	return t.Runner == "shell"
+	return t.Runner == "shell" || t.Runner == "ssh" || t.Interactive
+}
+
+// environ builds the environment for shell commands. With envClear or
+// envPassthrough only the listed variables are inherited.
+func (t *Target) environ() []string {
+	var env []string
+	if t.EnvClear || len(t.EnvPassthrough) > 0 {
+		for _, key := range t.EnvPassthrough {
+			if val, ok := os.LookupEnv(key); ok {
+				env = append(env, key+"="+val)
+			}
+		}
+	} else {
+		env = os.Environ()
+	}
+	for key, val := range t.envWithSecrets() {
+		env = append(env, key+"="+val)
+	}
+	return env
+}
+
+// envWithSecrets returns Env together with the values read from SecretFiles
+func (t *Target) envWithSecrets() map[string]string {
+	if len(t.secrets) == 0 {
+		return t.Env
+	}
+	env := make(map[string]string)
+	for key, val := range t.Env {
+		env[key] = val
+	}
+	for key, val := range t.secrets {
+		env[key] = val
+	}
+	return env
+}
+
+func (t *Target) hasLimits() bool {
+	return t.Nice != 0 || len(t.MemoryLimit) > 0 || t.OpenFiles > 0
+}
+
+// parseSize parses sizes such as "512M" into bytes
+func parseSize(str string) (uint64, error) {
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(str, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(str, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(str, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		str = str[:len(str)-1]
+	}
+
+	size, err := strconv.ParseUint(str, 10, 64)
+	if err != nil || size == 0 {
+		return 0, fmt.Errorf("invalid size: %s", str)
+	}
+	return size * mult, nil
+}
+
+// isCommandFlag checks for the bash flag which reads the command from the
+// next argument, e.g. "-c" or "-lc".
+func isCommandFlag(arg string) bool {
+	if len(arg) < 2 || arg[0] != '-' || arg[len(arg)-1] != 'c' {
+		return false
+	}
+	for _, ch := range arg[1:] {
+		if ch < 'a' || ch > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// shellCommand creates a bash command which runs the given command. It's
+// killed if ctx is cancelled.
+func (t *Target) shellCommand(ctx context.Context, command string) *exec.Cmd {
+	args := t.ShellArgs
+	if len(args) == 0 {
+		args = []string{"-c"}
+	}
+	if len(t.Umask) > 0 {
+		command = "umask " + t.Umask + " && " + command
+	}
+	args = append(append([]string{}, args...), command)
+	cmd := exec.CommandContext(ctx, "bash", args...)
+	cmd.Dir = t.Cwd
+	cmd.Env = t.environ()
+	return cmd
+}
+
+// supportsPlatform checks if the target can run on this OS. Other targets are
+// skipped.
+func (t *Target) supportsPlatform() bool {
+	if len(t.Platforms) == 0 {
+		return true
+	}
+	for _, platform := range t.Platforms {
+		if platform == runtime.GOOS {
+			return true
+		}
+	}
+	return false
 }
 
 func (job *Job) isNoop() bool {
+	if !job.target.supportsPlatform() || job.target.Disabled {
+		return true
+	}
 	if job.mode == TargetStop {
-		return job.target.Runner == "shell"
+		return (job.target.Runner == "shell" || job.target.Runner == "ssh") && len(job.target.AfterStop) == 0
 	}
-	return job.target.Command == ""
+	t := job.target
+	return t.Command == "" && t.Runner == "shell" && len(t.Templates) == 0 && len(t.Requires) == 0
 }
 
-func runJob(job *Job) error {
-	if len(job.target.Command) == 0 {
+// runJob runs the job. If ready is non-nil it's called once a blocking target
+// has passed its listens checks. Cancelling ctx kills the commands and stops
+// waiting for listens.
+func runJob(ctx context.Context, job *Job, ready func()) error {
+	t := job.target
+	if job.mode == TargetStart && job.command != t.Command {
+		// Run a copy with the outputs of other targets filled in
+		expanded := *t
+		expanded.Command = job.command
+		t = &expanded
+	}
+
+	if !t.supportsPlatform() || t.Disabled {
 		return nil
 	}
 
-	runner := runners[job.target.Runner]
+	if job.mode == TargetStart {
+		for _, command := range t.Requires {
+			if err := runHook(ctx, t, command); err != nil {
+				return fmt.Errorf("requirement not met: %s (%s)", command, err)
+			}
+		}
+		if err := t.renderTemplates(); err != nil {
+			return fmt.Errorf("failed to render template: %s", err)
+		}
+	}
+
+	if len(t.Command) == 0 {
+		if t.Runner == "shell" {
+			return nil
+		}
+		// validateTargets should have caught this
+		return fmt.Errorf("%s target has no command", t.Runner)
+	}
+
+	runner := runners[t.Runner]
 	if job.mode == TargetStop {
-		return runner.stop(job.target)
+		stop := runner.stop
+		if k, ok := runner.(killer); ok && job.kill {
+			stop = k.kill
+		}
+		if err := stop(ctx, t); err != nil {
+			return &RunnerError{t.Runner, t.Name, err}
+		}
+		if t.VerifyStopped {
+			if err := waitStopped(ctx, t); err != nil {
+				return err
+			}
+		}
+		if len(t.AfterStop) > 0 {
+			if err := runHook(ctx, t, t.AfterStop); err != nil {
+				if !t.AfterStopOptional {
+					return fmt.Errorf("afterStop failed: %s", err)
+				}
+				fmt.Fprintf(os.Stderr, "warning: afterStop of %s failed: %s\n", t.Name, err)
+			}
+		}
+		return nil
+	}
+
+	if ready != nil && t.isExclusive() && len(t.Listens) > 0 {
+		// The command won't return until it exits so check in the background
+		go func() {
+			if waitStarted(ctx, t) == nil {
+				ready()
+			}
+		}()
 	}
 
-	err := runner.start(job.target)
+	var stdout bytes.Buffer
+	if sr, ok := runner.(shellRunner); ok && t.Output {
+		sr.capture = &stdout
+		runner = sr
+	}
+
+	err := runner.start(ctx, t)
+	job.output = stdout.String()
+	if err == errAlreadyRunning {
+		job.alreadyRunning = true
+		err = nil
+	}
 	if err != nil {
+		return &RunnerError{t.Runner, t.Name, err}
+	}
+
+	if err := waitStarted(ctx, t); err != nil {
 		return err
 	}
 
-	for _, addr := range job.target.Listens {
+	if len(t.Verify) > 0 {
+		if err := runHook(ctx, t, t.Verify); err != nil {
+			return fmt.Errorf("verify failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// openStdin opens what the command of the target should read from instead of
+// the terminal (if stdin or stdinFile is set)
+func (t *Target) openStdin() (io.ReadCloser, error) {
+	if len(t.StdinFile) > 0 {
+		return os.Open(t.StdinFile)
+	}
+	if len(t.Stdin) > 0 {
+		return ioutil.NopCloser(strings.NewReader(t.Stdin)), nil
+	}
+	return nil, nil
+}
+
+// runHook runs an extra command for the target in its directory
+func runHook(ctx context.Context, t *Target, command string) error {
+	cmd := t.shellCommand(ctx, command)
+	_, err := combinedOutputError(cmd)
+	return err
+}
+
+// runCompletionHook runs the --on-complete command for a job
+func runCompletionHook(command string, job *Job) error {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"DOO_TARGET="+job.target.Name,
+		"DOO_STATUS="+job.status(),
+		"DOO_DURATION="+prettyDuration(job.duration()))
+	if job.err != nil {
+		cmd.Env = append(cmd.Env, "DOO_ERROR="+job.err.Error())
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// waitStarted waits for a target which was just started to listen. With
+// readyDelay it first gives the service time to crash during startup, since
+// some open their port before they're done initializing.
+func waitStarted(ctx context.Context, t *Target) error {
+	if len(t.ReadyDelay) > 0 {
+		// Validated in validateTargets
+		dur, _ := time.ParseDuration(t.ReadyDelay)
+		if err := sleepContext(ctx, dur); err != nil {
+			return err
+		}
+	}
+	return waitListens(ctx, t)
+}
+
+func waitListens(ctx context.Context, t *Target) error {
+	if len(t.ListenDeadline) > 0 {
+		// Validated in validateTargets
+		dur, _ := time.ParseDuration(t.ListenDeadline)
+		return waitListensUntil(ctx, t, time.Now().Add(dur))
+	}
+
+	for _, addr := range t.Listens {
 		for i := 0; ; i++ {
 			if i >= 10 {
-				return fmt.Errorf("service didn't listen to: %s", addr)
+				return &ListenTimeoutError{addr, i}
 			}
-			listens, err := checkListens(addr)
+			listens, err := t.checkListens(ctx, addr)
 			if err != nil {
 				return err
 			}
 			if listens {
 				break
 			}
-			time.Sleep(expSleepTime(i))
+			if err := sleepContext(ctx, expSleepTime(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// waitListensUntil is like waitListens, but keeps checking until the deadline
+// instead of giving up after a number of attempts
+func waitListensUntil(ctx context.Context, t *Target, deadline time.Time) error {
+	for _, addr := range t.Listens {
+		for i := 0; ; i++ {
+			listens, err := t.checkListens(ctx, addr)
+			if err != nil {
+				return err
+			}
+			if listens {
+				break
+			}
+
+			left := time.Until(deadline)
+			if left <= 0 {
+				return &ListenTimeoutError{addr, i + 1}
+			}
+			if sleep := expSleepTime(i); sleep < left {
+				left = sleep
+			}
+			if err := sleepContext(ctx, left); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// waitStopped waits until the target no longer listens to its addresses
+func waitStopped(ctx context.Context, t *Target) error {
+	for _, addr := range t.Listens {
+		for i := 0; ; i++ {
+			if i >= 10 {
+				return fmt.Errorf("service still listens to: %s", addr)
+			}
+			listens, err := t.checkListens(ctx, addr)
+			if err != nil {
+				return err
+			}
+			if !listens {
+				break
+			}
+			if err := sleepContext(ctx, expSleepTime(i)); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func checkListens(addr string) (bool, error) {
+func (t *Target) checkListens(ctx context.Context, addr string) (bool, error) {
+	if t.Runner == "ssh" {
+		return checkRemoteListens(ctx, t, addr)
+	}
+	return checkListens(ctx, addr, t.ListenFrom)
+}
+
+// sleepContext sleeps for the duration, but returns early with an error if
+// ctx is cancelled
+func sleepContext(ctx context.Context, dur time.Duration) error {
+	timer := time.NewTimer(dur)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+const (
+	// unixPrefix marks a listen address as a path which must be a socket
+	unixPrefix = "unix://"
+	// fifoPrefix marks a listen address as a path which must be a named pipe
+	fifoPrefix = "fifo://"
+)
+
+// checkListenAddr checks that addr is a path or a host:port. IPv6 addresses
+// must be in brackets, e.g. [::1]:3000.
+func checkListenAddr(addr string) error {
+	if len(addr) == 0 {
+		return fmt.Errorf("empty address")
+	}
+	if addr[0] == '/' || strings.HasPrefix(addr, unixPrefix) || strings.HasPrefix(addr, fifoPrefix) {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	_, err = net.LookupPort("tcp", port)
+	return err
+}
+
+// checkListens checks if something listens to addr. from is the local IP to
+// dial from (if any).
+func checkListens(ctx context.Context, addr string, from string) (bool, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		fi, err := os.Stat(strings.TrimPrefix(addr, unixPrefix))
+		if err != nil {
+			return false, nil
+		}
+		return fi.Mode()&os.ModeSocket != 0, nil
+	}
+
+	if strings.HasPrefix(addr, fifoPrefix) {
+		fi, err := os.Stat(strings.TrimPrefix(addr, fifoPrefix))
+		if err != nil {
+			return false, nil
+		}
+		return fi.Mode()&os.ModeNamedPipe != 0, nil
+	}
+
 	if addr[0] == '/' {
-		_, err := os.Stat(addr)
-		return !os.IsNotExist(err), nil
+		fi, err := os.Stat(addr)
+		if err != nil {
+			return !os.IsNotExist(err), nil
+		}
+		// Something like a directory with the same name doesn't count
+		return fi.Mode().IsRegular() || fi.Mode()&(os.ModeSocket|os.ModeNamedPipe) != 0, nil
+	}
+
+	dialer := net.Dialer{Timeout: time.Second}
+	if len(from) > 0 {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(from)}
 	}
 
-	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
-		operr := err.(*net.OpError)
-		if syscallErr, ok := operr.Err.(*os.SyscallError); ok {
-			if syscallErr.Err == syscall.ECONNREFUSED {
-				return false, nil
-			}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return false, nil
 		}
 	} else {
 		conn.Close()
@@ -91,62 +520,609 @@ func checkListens(addr string) (bool, error) {
 	return true, err
 }
 
+// outputTail limits the output included in errors to the last lines (0
+// means no limit)
+var outputTail = 0
+
+// verbose makes doo print the commands run by the runners (see --verbose)
+var verbose = false
+
+// traceCommand prints the command (with quoted arguments) if verbose is set
+func traceCommand(cmd *exec.Cmd) {
+	if !verbose {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "+ %s\n", traceLine(cmd.Args))
+}
+
+// exportPattern matches the variables exported by the ssh runner
+var exportPattern = regexp.MustCompile(`export (\w+)='(?:[^']|'\\'')*'`)
+
+// traceLine quotes the arguments of a command for printing. The values of
+// environment variables are left out since they might be secrets.
+func traceLine(cmdArgs []string) string {
+	args := make([]string, len(cmdArgs))
+	for i, arg := range cmdArgs {
+		if i > 0 && cmdArgs[0] == "tmux" && cmdArgs[i-1] == "-e" {
+			// tmux new-session -e KEY=VALUE
+			arg = strings.SplitN(arg, "=", 2)[0] + "=***"
+		}
+		arg = exportPattern.ReplaceAllString(arg, "export $1=***")
+		if len(arg) == 0 || strings.ContainsAny(arg, " \t\n'\"\\$`;&|<>()*?[]#~{}!") {
+			arg = shellQuote(arg)
+		}
+		args[i] = arg
+	}
+	return strings.Join(args, " ")
+}
+
 func combinedOutputError(cmd *exec.Cmd) ([]byte, error) {
+	traceCommand(cmd)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		if len(output) > 1 {
-			err = fmt.Errorf("%s\n%s", err, string(output))
+			err = fmt.Errorf("%s\n%s", err, tailLines(string(output), outputTail))
 		}
 		return nil, err
 	}
 	return output, nil
 }
 
+// tailLines keeps the last n lines of str and notes how many were dropped
+func tailLines(str string, n int) string {
+	lines := strings.Split(strings.TrimSuffix(str, "\n"), "\n")
+	if n <= 0 || len(lines) <= n {
+		return str
+	}
+	omitted := len(lines) - n
+	return fmt.Sprintf("(… %d lines omitted)\n%s\n", omitted, strings.Join(lines[omitted:], "\n"))
+}
+
+// openLogFile opens a log file for appending, creating its directory if needed
+func openLogFile(fpath string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// teeLog makes the command write its output to the log as well
+func teeLog(cmd *exec.Cmd, log io.Writer) {
+	w := &syncWriter{w: log}
+	cmd.Stdout = io.MultiWriter(cmd.Stdout, w)
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, w)
+}
+
 // Shell
-type shellRunner struct{}
+type shellRunner struct {
+	// If out is set the output is buffered and written to it in one go once
+	// the command exits
+	out io.Writer
+	// capture receives a copy of stdout
+	capture io.Writer
+	// pidDir keeps the PIDs of running commands (if set) so that they can be
+	// stopped by another doo
+	pidDir string
+}
 
-func (r shellRunner) start(t *Target) error {
-	cmd := exec.Command("bash", "-c", t.Command)
-	cmd.Dir = t.Cwd
+func (r shellRunner) start(ctx context.Context, t *Target) error {
+	if t.DetachWhenReady {
+		return r.startDetached(ctx, t)
+	}
+
+	var buf bytes.Buffer
+	cmd := t.shellCommand(ctx, t.Command)
 	cmd.Stdin = os.Stdin
+	if t.ProcessGroup {
+		// A background process group is stopped if it reads from the
+		// terminal
+		cmd.Stdin = nil
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error {
+			// Stop everything the command has started, not just the shell
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+	if stdin, err := t.openStdin(); err != nil {
+		return err
+	} else if stdin != nil {
+		defer stdin.Close()
+		cmd.Stdin = stdin
+	}
+	if r.out != nil {
+		// stdout and stderr are copied separately when capturing
+		w := &syncWriter{w: &buf}
+		cmd.Stdout = w
+		cmd.Stderr = w
+		defer func() {
+			if buf.Len() > 0 {
+				if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+					buf.WriteByte('\n')
+				}
+				r.out.Write(buf.Bytes())
+			}
+		}()
+	} else {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	if r.capture != nil {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, r.capture)
+	}
+	if len(t.LogFile) > 0 {
+		f, err := openLogFile(t.LogFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		teeLog(cmd, f)
+	}
+	if t.hasLimits() {
+		if err := limitCommand(cmd, t); err != nil {
+			return err
+		}
+	}
+	traceCommand(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if t.ProcessGroup {
+		defer forwardSignals(cmd.Process.Pid)()
+	}
+	r.writePid(t, cmd.Process.Pid)
+	defer r.removePid(t)
+	return cmd.Wait()
+}
+
+// forwardSignals sends SIGINT and SIGTERM received by doo to the process
+// group. The terminal only signals its foreground group (which is doo's), so
+// otherwise Ctrl-C would never reach the command. It returns a function which
+// stops forwarding.
+func forwardSignals(pgid int) func() {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				syscall.Kill(-pgid, sig.(syscall.Signal))
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// startDetached starts the command in its own process group and returns once
+// it listens, leaving it running after doo exits. Its output goes straight to
+// the terminal (or the log file) since doo won't be around to copy it.
+func (r shellRunner) startDetached(ctx context.Context, t *Target) error {
+	// The command outlives doo so it can't be tied to ctx
+	cmd := t.shellCommand(context.Background(), t.Command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if len(t.LogFile) > 0 {
+		f, err := openLogFile(t.LogFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cmd.Stdout = f
+		cmd.Stderr = f
+	}
+	if t.hasLimits() {
+		if err := limitCommand(cmd, t); err != nil {
+			return err
+		}
+	}
+	traceCommand(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Kept after doo exits so that the command can be stopped later
+	r.writePid(t, cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	ready := make(chan error, 1)
+	go func() {
+		ready <- waitStarted(ctx, t)
+	}()
+
+	select {
+	case err := <-exited:
+		r.removePid(t)
+		if err == nil {
+			err = fmt.Errorf("exited before it was ready")
+		}
+		return err
+	case err := <-ready:
+		if err != nil {
+			// Kill the whole group so nothing is left behind
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			r.removePid(t)
+		}
+		return err
+	}
+}
+
+func (r shellRunner) pidFile(t *Target) string {
+	return filepath.Join(r.pidDir, strings.Replace(t.Name, "/", "_", -1)+".pid")
+}
+
+func (r shellRunner) writePid(t *Target, pid int) {
+	if len(r.pidDir) == 0 {
+		return
+	}
+	if err := os.MkdirAll(r.pidDir, 0700); err == nil {
+		ioutil.WriteFile(r.pidFile(t), []byte(strconv.Itoa(pid)+"\n"), 0600)
+	}
+}
+
+func (r shellRunner) removePid(t *Target) {
+	if len(r.pidDir) > 0 {
+		os.Remove(r.pidFile(t))
+	}
+}
+
+// signal sends a signal to the running command of the target, and to
+// everything it started if it runs in its own process group. It does nothing
+// if the command isn't running.
+func (r shellRunner) signal(t *Target, sig syscall.Signal) error {
+	if len(r.pidDir) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.pidFile(t))
+	if err != nil {
+		return nil
+	}
+	defer r.removePid(t)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return nil
+	}
+	if pgid, err := syscall.Getpgid(pid); err != nil {
+		// Not running anymore
+		return nil
+	} else if pgid == pid {
+		pid = -pid
+	}
+	if err := syscall.Kill(pid, sig); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// stop stops detached targets. Other shell targets stop with doo.
+func (r shellRunner) stop(ctx context.Context, t *Target) error {
+	if !t.DetachWhenReady {
+		return nil
+	}
+	return r.signal(t, syscall.SIGTERM)
+}
+
+func (r shellRunner) kill(ctx context.Context, t *Target) error {
+	return r.signal(t, syscall.SIGKILL)
+}
+
+func (r shellRunner) check() error {
+	_, err := exec.LookPath("bash")
+	return err
+}
+
+// SSH
+type sshRunner struct{}
+
+// sshCommand runs a command on the host of the target. Connections are shared
+// between commands.
+func sshCommand(ctx context.Context, t *Target, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "ssh",
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=~/.ssh/doo-%C",
+		"-o", "ControlPersist=60",
+		t.Host, command)
+}
+
+func (r sshRunner) start(ctx context.Context, t *Target) error {
+	var command string
+	for key, val := range t.envWithSecrets() {
+		command += "export " + key + "=" + shellQuote(val) + "; "
+	}
+	if len(t.Cwd) > 0 {
+		command += "cd " + shellQuote(t.Cwd) + " && "
+	}
+	if len(t.Umask) > 0 {
+		command += "umask " + t.Umask + " && "
+	}
+	command += t.Command
+
+	cmd := sshCommand(ctx, t, command)
+	cmd.Stdin = os.Stdin
+	if stdin, err := t.openStdin(); err != nil {
+		return err
+	} else if stdin != nil {
+		defer stdin.Close()
+		cmd.Stdin = stdin
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if len(t.LogFile) > 0 {
+		f, err := openLogFile(t.LogFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		teeLog(cmd, f)
+	}
+	traceCommand(cmd)
 	return cmd.Run()
 }
 
-func (r shellRunner) stop(t *Target) error {
+func (r sshRunner) stop(ctx context.Context, t *Target) error {
 	return nil
 }
 
+func (r sshRunner) check() error {
+	_, err := exec.LookPath("ssh")
+	return err
+}
+
+// checkRemoteListens checks an address on the host of the target
+func checkRemoteListens(ctx context.Context, t *Target, addr string) (bool, error) {
+	var test string
+	if strings.HasPrefix(addr, unixPrefix) {
+		test = "test -S " + shellQuote(strings.TrimPrefix(addr, unixPrefix))
+	} else if strings.HasPrefix(addr, fifoPrefix) {
+		test = "test -p " + shellQuote(strings.TrimPrefix(addr, fifoPrefix))
+	} else if addr[0] == '/' {
+		test = "test -f " + shellQuote(addr) + " -o -S " + shellQuote(addr) + " -o -p " + shellQuote(addr)
+	} else {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return false, err
+		}
+		if len(host) == 0 {
+			host = "127.0.0.1"
+		}
+		test = "bash -c " + shellQuote(fmt.Sprintf("echo > /dev/tcp/%s/%s", host, port))
+	}
+
+	cmd := sshCommand(ctx, t, test)
+	traceCommand(cmd)
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() != 255 {
+			// The check failed, as opposed to ssh itself
+			return false, nil
+		}
+	}
+	return err == nil, err
+}
+
 // Tmux
 type tmuxRunner struct{}
 
 func tmuxSessionExists(t *Target) bool {
-	cmd := exec.Command("tmux", "has-session", "-t", t.Name)
+	cmd := exec.Command("tmux", "has-session", "-t", "="+t.Name)
+	traceCommand(cmd)
 	return cmd.Run() == nil
 }
 
-func (r tmuxRunner) start(t *Target) error {
+// tmuxEscape escapes an argument so tmux doesn't treat a trailing semicolon
+// as a command separator.
+func tmuxEscape(arg string) string {
+	if strings.HasSuffix(arg, ";") {
+		return arg[:len(arg)-1] + "\\;"
+	}
+	return arg
+}
+
+func (r tmuxRunner) start(ctx context.Context, t *Target) error {
+	err := r.createSession(ctx, t)
+	if err != nil && err != errAlreadyRunning {
+		return err
+	}
+	if t.Interactive {
+		if err := tmuxAttach(t); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// tmuxSocketArgs returns the arguments for connecting to the tmux server doo
+// runs in (if TMUX is set), so that commands keep using it after TMUX has been
+// removed from their environment.
+func tmuxSocketArgs() []string {
+	if env := os.Getenv("TMUX"); len(env) > 0 {
+		return []string{"-S", strings.SplitN(env, ",", 2)[0]}
+	}
+	return nil
+}
+
+// tmuxAttach attaches the terminal to the session of the target until the
+// user detaches.
+func tmuxAttach(t *Target) error {
+	cmd := exec.Command("tmux", append(tmuxSocketArgs(), "attach-session", "-t", "="+t.Name)...)
+	for _, env := range os.Environ() {
+		// tmux refuses to attach from inside another session
+		if !strings.HasPrefix(env, "TMUX=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	traceCommand(cmd)
+	return cmd.Run()
+}
+
+func (r tmuxRunner) createSession(ctx context.Context, t *Target) error {
 	if tmuxSessionExists(t) {
-		return nil
+		return errAlreadyRunning
 	}
-	cmd := exec.Command("tmux", "new-session", "-d", "-s", t.Name)
-	if len(t.Cwd) > 0 {
-		cmd.Args = append(cmd.Args, "-c", t.Cwd)
+	if len(t.LogFile) > 0 {
+		if err := os.MkdirAll(filepath.Dir(t.LogFile), 0755); err != nil {
+			return err
+		}
 	}
-	cmd.Args = append(cmd.Args, ";", "send-keys", t.Command, "Enter")
+	cmd := exec.CommandContext(ctx, "tmux", tmuxSessionArgs(t)...)
 	_, err := combinedOutputError(cmd)
 	return err
 }
 
-func (r tmuxRunner) stop(t *Target) error {
+// tmuxSessionArgs composes the tmux commands which create the session of the
+// target and send its command to it
+func tmuxSessionArgs(t *Target) []string {
+	args := []string{"new-session", "-d", "-s", t.Name}
+	if len(t.Cwd) > 0 {
+		args = append(args, "-c", t.Cwd)
+	}
+	for key, val := range t.envWithSecrets() {
+		args = append(args, "-e", key+"="+val)
+	}
+	// Mark the session so --prune can find it
+	args = append(args, ";", "set-option", "@doo", "1")
+	if len(t.LogFile) > 0 {
+		args = append(args, ";", "pipe-pane", "-o", "cat >> "+shellQuote(t.LogFile))
+	}
+	// Send the command literally (so it isn't parsed as key names) and then
+	// press Enter separately
+	command := t.Command
+	if len(t.Umask) > 0 {
+		command = "umask " + t.Umask + " && " + command
+	}
+	args = append(args, ";", "send-keys", "-l", "--", tmuxEscape(command))
+	return append(args, ";", "send-keys", "Enter")
+}
+
+func (r tmuxRunner) stop(ctx context.Context, t *Target) error {
 	if !tmuxSessionExists(t) {
 		return nil
 	}
-	cmd := exec.Command("tmux", "kill-session", "-t", t.Name)
+	cmd := exec.CommandContext(ctx, "tmux", "kill-session", "-t", "="+t.Name)
+	traceCommand(cmd)
 	return cmd.Run()
 }
 
+func (r tmuxRunner) alive(t *Target) (bool, error) {
+	return tmuxSessionExists(t), nil
+}
+
+func (r tmuxRunner) instances() ([]string, error) {
+	cmd := exec.Command("tmux", "list-sessions", "-F", "#{session_name}\t#{@doo}")
+	traceCommand(cmd)
+	output, err := cmd.Output()
+	if err != nil {
+		// tmux fails if there's no server running
+		return nil, nil
+	}
+
+	var res []string
+	for _, line := range strings.Split(string(output), "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) == 2 && parts[1] == "1" {
+			res = append(res, parts[0])
+		}
+	}
+	return res, nil
+}
+
+func (r tmuxRunner) remove(name string) error {
+	cmd := exec.Command("tmux", "kill-session", "-t", "="+name)
+	_, err := combinedOutputError(cmd)
+	return err
+}
+
+func (r tmuxRunner) check() error {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		return err
+	}
+	_, err := combinedOutputError(exec.Command("tmux", "-V"))
+	return err
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// attachAllSession is the session --attach-all shows the targets in. It's
+// marked with @doo-layout so that a session doo didn't create (e.g. a target
+// with the same name) is never replaced.
+const attachAllSession = "doo-attach-all"
+
+// tmuxLayoutArgs composes the tmux commands for a session which shows all the
+// sessions of targets as tiled panes. Sessions are matched exactly (with =)
+// since tmux otherwise picks any session starting with the name.
+func tmuxLayoutArgs(session string, targets []*Target) []string {
+	var args []string
+	for i, t := range targets {
+		// Unset TMUX so tmux allows the nested attach, but keep using the
+		// server the pane runs in
+		attach := "TMUX= tmux -S \"${TMUX%%,*}\" attach-session -t " + shellQuote("="+t.Name)
+		if i == 0 {
+			args = append(args, "new-session", "-d", "-s", session, attach)
+			args = append(args, ";", "set-option", "@doo-layout", "1")
+		} else {
+			args = append(args, ";", "split-window", "-t", "="+session+":", attach)
+			args = append(args, ";", "select-layout", "-t", "="+session+":", "tiled")
+		}
+	}
+	return args
+}
+
+// tmuxAttachAll replaces the current process with a tmux client showing all
+// the targets.
+func tmuxAttachAll(targets []*Target) error {
+	for _, t := range targets {
+		if !tmuxSessionExists(t) {
+			return fmt.Errorf("%s is not running", t.Name)
+		}
+	}
+
+	session := attachAllSession
+	target := "=" + session
+	hasCmd := exec.Command("tmux", "has-session", "-t", target)
+	traceCommand(hasCmd)
+	if hasCmd.Run() == nil {
+		// Only replace the layout of an earlier --attach-all
+		markCmd := exec.Command("tmux", "display-message", "-p", "-t", target+":", "#{@doo-layout}")
+		output, err := combinedOutputError(markCmd)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(output)) != "1" {
+			return fmt.Errorf("tmux session %s wasn't created by doo", session)
+		}
+		if _, err := combinedOutputError(exec.Command("tmux", "kill-session", "-t", target)); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command("tmux", tmuxLayoutArgs(session, targets)...)
+	if _, err := combinedOutputError(cmd); err != nil {
+		return err
+	}
+
+	tmux, err := exec.LookPath("tmux")
+	if err != nil {
+		return err
+	}
+	args := []string{"tmux", "attach-session", "-t", target}
+	if len(os.Getenv("TMUX")) > 0 {
+		args = []string{"tmux", "switch-client", "-t", target}
+	}
+	return syscall.Exec(tmux, args, os.Environ())
+}
+
 // Launchd
 type launchdRunner struct {
 	loadedServices map[string]bool
@@ -158,42 +1134,51 @@ func (r *launchdRunner) findLabel(filename string) (string, error) {
 	return strings.TrimSpace(string(output)), err
 }
 
-func (r *launchdRunner) start(t *Target) error {
+func (r *launchdRunner) start(ctx context.Context, t *Target) error {
 	user, err := user.Current()
 	if err != nil {
 		return err
 	}
 	domain := fmt.Sprintf("gui/%s", user.Uid)
-	cmd := exec.Command("launchctl", "bootstrap", domain, t.Command)
+	cmd := exec.CommandContext(ctx, "launchctl", "bootstrap", domain, t.Command)
 	_, err = combinedOutputError(cmd)
 	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
 		if status == 34048 {
 			// service already loaded
-			err = nil
+			err = errAlreadyRunning
 		}
 	}
 	return err
 }
 
-func (r *launchdRunner) stop(t *Target) error {
+func (r *launchdRunner) serviceTarget(t *Target) (string, error) {
 	label, err := r.findLabel(t.Command)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	user, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("gui/%s/%s", user.Uid, label), nil
+}
+
+func (r *launchdRunner) stop(ctx context.Context, t *Target) error {
+	domain, err := r.serviceTarget(t)
 	if err != nil {
 		return err
 	}
-	domain := fmt.Sprintf("gui/%s/%s", user.Uid, label)
 
 	for i := 0; ; i++ {
-		cmd := exec.Command("launchctl", "bootout", domain)
+		cmd := exec.CommandContext(ctx, "launchctl", "bootout", domain)
 		_, err = combinedOutputError(cmd)
 		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
 			if status == 9216 {
 				// Operation now in progress
-				time.Sleep(expSleepTime(i))
+				if err := sleepContext(ctx, expSleepTime(i)); err != nil {
+					return err
+				}
 				continue
 			}
 			if status == 768 {
@@ -206,10 +1191,68 @@ func (r *launchdRunner) stop(t *Target) error {
 	return err
 }
 
+func (r *launchdRunner) alive(t *Target) (bool, error) {
+	domain, err := r.serviceTarget(t)
+	if err != nil {
+		return false, err
+	}
+	// Fails if the service isn't loaded
+	cmd := exec.Command("launchctl", "print", domain)
+	traceCommand(cmd)
+	return cmd.Run() == nil, nil
+}
+
+// kill sends SIGKILL to the service and unloads it without waiting for it to
+// shut down
+func (r *launchdRunner) kill(ctx context.Context, t *Target) error {
+	domain, err := r.serviceTarget(t)
+	if err != nil {
+		return err
+	}
+
+	// Fails if the service isn't running, which is fine
+	killCmd := exec.CommandContext(ctx, "launchctl", "kill", "SIGKILL", domain)
+	traceCommand(killCmd)
+	killCmd.Run()
+
+	cmd := exec.CommandContext(ctx, "launchctl", "bootout", domain)
+	_, err = combinedOutputError(cmd)
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		if status == 9216 || status == 768 {
+			// Already going away
+			err = nil
+		}
+	}
+	return err
+}
+
+func (r *launchdRunner) check() error {
+	for _, name := range []string{"launchctl", "defaults"} {
+		if _, err := exec.LookPath(name); err != nil {
+			return err
+		}
+	}
+
+	user, err := user.Current()
+	if err != nil {
+		return err
+	}
+	// Make sure we can access the domain the services are started in
+	_, err = combinedOutputError(exec.Command("launchctl", "print", "gui/"+user.Uid))
+	return err
+}
+
+// backoffJitter is how much expSleepTime randomly varies the delay (0.25 means
+// ±25%) so that loops started at the same time don't poll in lockstep
+var backoffJitter = 0.25
+
 func expSleepTime(i int) time.Duration {
 	var res = 50 * time.Millisecond
 	for ; i > 0; i-- {
 		res *= 2
 	}
+	if backoffJitter > 0 {
+		res += time.Duration((rand.Float64()*2 - 1) * backoffJitter * float64(res))
+	}
 	return res
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTmuxEscape(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"echo hi", "echo hi"},
+		{"echo a; echo b", "echo a; echo b"},
+		{"echo a;", `echo a\;`},
+		{`echo "a b"`, `echo "a b"`},
+		{"echo $HOME", "echo $HOME"},
+		{`echo "$HOME";`, `echo "$HOME"\;`},
+	}
+	for _, tt := range tests {
+		if got := tmuxEscape(tt.arg); got != tt.want {
+			t.Errorf("tmuxEscape(%q) = %q, want %q", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestTmuxSessionArgs(t *testing.T) {
+	tests := []struct {
+		command string
+		umask   string
+		want    string
+	}{
+		{"bin/server; echo done", "", "bin/server; echo done"},
+		{"bin/server;", "", `bin/server\;`},
+		{`echo "hello world"`, "", `echo "hello world"`},
+		{"echo $PORT ${HOME}", "", "echo $PORT ${HOME}"},
+		{"Enter", "", "Enter"},
+		{"echo $A;", "022", `umask 022 && echo $A\;`},
+	}
+	for _, tt := range tests {
+		target := &Target{Name: "web", Command: tt.command, Umask: tt.umask}
+		args := tmuxSessionArgs(target)
+
+		want := []string{";", "send-keys", "-l", "--", tt.want, ";", "send-keys", "Enter"}
+		if len(args) < len(want) || !reflect.DeepEqual(args[len(args)-len(want):], want) {
+			t.Errorf("tmuxSessionArgs for %q = %q, want it to end with %q", tt.command, args, want)
+		}
+		if !reflect.DeepEqual(args[:4], []string{"new-session", "-d", "-s", "web"}) {
+			t.Errorf("tmuxSessionArgs for %q = %q, want a new session called web", tt.command, args)
+		}
+	}
+}
+
+func TestCheckListenAddr(t *testing.T) {
+	valid := []string{":3000", "127.0.0.1:3000", "[::1]:3000", "[::]:http", "localhost:3000", "/tmp/app.sock", "unix:///tmp/app.sock"}
+	for _, addr := range valid {
+		if err := checkListenAddr(addr); err != nil {
+			t.Errorf("checkListenAddr(%q) = %v, want nil", addr, err)
+		}
+	}
+
+	invalid := []string{"", "3000", "::1:3000", "localhost", "[::1]:nope"}
+	for _, addr := range invalid {
+		if err := checkListenAddr(addr); err == nil {
+			t.Errorf("checkListenAddr(%q) = nil, want an error", addr)
+		}
+	}
+}
+
+// listenOn listens on addr and returns the port, skipping the test if the
+// address isn't available (e.g. no IPv6)
+func listenOn(t *testing.T, addr string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("can't listen on %s: %s", addr, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func TestCheckListensIPv6(t *testing.T) {
+	port := listenOn(t, "[::1]:0")
+	ctx := context.Background()
+
+	listens, err := checkListens(ctx, "[::1]:"+port, "")
+	if err != nil || !listens {
+		t.Errorf("checkListens([::1]:%s) = %v, %v, want true", port, listens, err)
+	}
+
+	listens, err = checkListens(ctx, "[::1]:"+port, "::1")
+	if err != nil || !listens {
+		t.Errorf("checkListens([::1]:%s) from ::1 = %v, %v, want true", port, listens, err)
+	}
+}
+
+func TestCheckListensMultipleAddresses(t *testing.T) {
+	addrs, err := net.LookupHost("localhost")
+	if err != nil || len(addrs) < 2 {
+		t.Skipf("localhost doesn't resolve to several addresses: %v", addrs)
+	}
+	ctx := context.Background()
+
+	// Only one of the addresses of localhost listens, which is enough
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		port := listenOn(t, addr)
+		listens, err := checkListens(ctx, "localhost:"+port, "")
+		if err != nil || !listens {
+			t.Errorf("checkListens(localhost:%s) with %s listening = %v, %v, want true", port, addr, listens, err)
+		}
+	}
+}
+
+func TestCheckListensRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	listens, err := checkListens(context.Background(), addr, "")
+	if err != nil || listens {
+		t.Errorf("checkListens(%s) = %v, %v, want false", addr, listens, err)
+	}
+}
+
+func TestTmuxLayoutArgs(t *testing.T) {
+	targets := []*Target{{Name: "web"}, {Name: "db"}}
+	got := strings.Join(tmuxLayoutArgs("layout", targets), " ")
+	want := `new-session -d -s layout TMUX= tmux -S "${TMUX%%,*}" attach-session -t '=web'` +
+		` ; set-option @doo-layout 1` +
+		` ; split-window -t =layout: TMUX= tmux -S "${TMUX%%,*}" attach-session -t '=db'` +
+		` ; select-layout -t =layout: tiled`
+	if got != want {
+		t.Errorf("tmuxLayoutArgs() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTraceLineRedactsEnv(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{
+			[]string{"tmux", "new-session", "-d", "-s", "web", "-e", "TOKEN=s3cr3t", ";", "send-keys", "-e"},
+			"tmux new-session -d -s web -e 'TOKEN=***' ';' send-keys -e",
+		},
+		{
+			[]string{"ssh", "host", `export TOKEN='s3'\''cr3t'; export B='x'; bin/deploy`},
+			`ssh host 'export TOKEN=***; export B=***; bin/deploy'`,
+		},
+		{
+			[]string{"bash", "-c", "echo hi"},
+			"bash -c 'echo hi'",
+		},
+	}
+	for _, test := range tests {
+		got := traceLine(test.args)
+		if got != test.want {
+			t.Errorf("traceLine(%q) = %s, want %s", test.args, got, test.want)
+		}
+		if strings.Contains(got, "s3") {
+			t.Errorf("traceLine(%q) leaks the secret", test.args)
+		}
+	}
+}
+
+func TestLimitsApplyToChildren(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("resource limits are only supported on Linux")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	target := &Target{
+		Name:        "limited",
+		Runner:      "shell",
+		Command:     "bash -c 'ulimit -n; ulimit -v; nice' > " + shellQuote(out),
+		Nice:        5,
+		MemoryLimit: "512M",
+		OpenFiles:   64,
+	}
+	if err := (shellRunner{}).start(context.Background(), target); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Fields(string(data)), []string{"64", "524288", "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("limits of a child = %v, want %v", got, want)
+	}
+}
+
+func TestKillDetachedShellTarget(t *testing.T) {
+	dir := t.TempDir()
+	ready := filepath.Join(dir, "ready")
+	target := &Target{
+		Name:            "server",
+		Runner:          "shell",
+		Command:         "touch " + shellQuote(ready) + "; sleep 100 & sleep 100",
+		Listens:         []string{ready},
+		DetachWhenReady: true,
+	}
+	r := shellRunner{pidDir: filepath.Join(dir, "pids")}
+	if err := r.start(context.Background(), target); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(r.pidFile(target))
+	if err != nil {
+		t.Fatalf("PID wasn't recorded: %v", err)
+	}
+	pgid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+
+	if err := r.kill(context.Background(), target); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for syscall.Kill(-pgid, 0) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("process group %d is still running", pgid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(r.pidFile(target)); !os.IsNotExist(err) {
+		t.Errorf("PID file wasn't removed")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// printCounts prints the counts sorted by key
+func (d *doo) printCounts(title string, counts map[string]int) {
+	var keys []string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(d.out, "%s:\n", title)
+	for _, key := range keys {
+		fmt.Fprintf(d.out, "  %5d  %s\n", counts[key], key)
+	}
+}
+
+// printStats summarizes the loaded targets (see --stats)
+func (d *doo) printStats() {
+	byRunner := make(map[string]int)
+	byConfig := make(map[string]int)
+	relations := make(map[string]int)
+
+	for _, t := range d.targets {
+		byRunner[t.Runner]++
+		byConfig[t.config.Path]++
+		relations["dependencies"] += len(t.Dependencies)
+		relations["waitFor"] += len(t.WaitFor)
+		relations["after"] += len(t.After)
+		relations["invokes"] += len(t.Invokes)
+		relations["invokesOnFailure"] += len(t.InvokesOnFailure)
+		relations["aliases"] += len(t.Aliases)
+		if len(t.Listens) > 0 {
+			relations["targets with listens"]++
+		}
+	}
+
+	fmt.Fprintf(d.out, "%d targets in %d config files\n", len(d.targets), len(byConfig))
+	d.printCounts("Runners", byRunner)
+	d.printCounts("Config files", byConfig)
+	d.printCounts("Relations", relations)
+}
@@ -0,0 +1,57 @@
+package main
+
+import "fmt"
+
+// levenshtein returns the edit distance between a and b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// suggest finds the target (or alias) closest to name and formats it as a
+// hint for error messages. Returns an empty string if nothing is close.
+func (d *doo) suggest(name string) string {
+	best, bestDist := "", 0
+	consider := func(candidate string) {
+		dist := levenshtein(name, candidate)
+		if len(best) == 0 || dist < bestDist || (dist == bestDist && candidate < best) {
+			best, bestDist = candidate, dist
+		}
+	}
+
+	for candidate := range d.targetMap {
+		consider(candidate)
+	}
+	for candidate := range d.aliasMap {
+		consider(candidate)
+	}
+
+	// Anything further away is more likely to confuse than help
+	if len(best) == 0 || bestDist > 3 || bestDist >= len([]rune(name)) {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean '%s'?)", best)
+}
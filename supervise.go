@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// sameAs reports whether two definitions of a target would run the same way
+func (t *Target) sameAs(other *Target) bool {
+	return t.Runner == other.Runner &&
+		t.Command == other.Command &&
+		t.Cwd == other.Cwd &&
+		reflect.DeepEqual(t.Env, other.Env) &&
+		reflect.DeepEqual(t.secrets, other.secrets) &&
+		reflect.DeepEqual(t.Listens, other.Listens)
+}
+
+// restartTracker keeps track of crashed targets between checks
+type restartTracker struct {
+	crashedAt map[string]time.Time
+	restarts  map[string][]time.Time
+	gaveUp    map[string]bool
+}
+
+func (d *doo) supervise(ctx context.Context, l *log.Logger, query []string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	tracker := &restartTracker{
+		crashedAt: make(map[string]time.Time),
+		restarts:  make(map[string][]time.Time),
+		gaveUp:    make(map[string]bool),
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			l.Println("reloading configuration")
+			if next := d.reload(ctx, l, query); next != nil {
+				d = next
+			}
+		case now := <-ticker.C:
+			d.restartCrashed(l, tracker, now)
+		}
+	}
+}
+
+// restartCrashed restarts the targets with a restart policy which are no
+// longer running. tmux and launchd can't tell how the command exited so
+// on-failure and always both restart a target once it's gone.
+func (d *doo) restartCrashed(l *log.Logger, tracker *restartTracker, now time.Time) {
+	for name, job := range d.jobs {
+		t := job.target
+		if job.mode != TargetStart || !job.done || t.Restart == "" || t.Restart == "never" || tracker.gaveUp[name] {
+			continue
+		}
+
+		// Keep retrying a failed restart, otherwise check if it's still up
+		if job.err == nil {
+			alive, err := runners[t.Runner].(liveChecker).alive(t)
+			if err != nil || alive {
+				delete(tracker.crashedAt, name)
+				continue
+			}
+		}
+
+		crashedAt, ok := tracker.crashedAt[name]
+		if !ok {
+			crashedAt = now
+			tracker.crashedAt[name] = now
+			l.Printf("%s is no longer running", name)
+		}
+		// Validated in validateTargets
+		delay, _ := time.ParseDuration(t.RestartDelay)
+		if now.Sub(crashedAt) < delay {
+			continue
+		}
+
+		window := time.Minute
+		if len(t.RestartWindow) > 0 {
+			window, _ = time.ParseDuration(t.RestartWindow)
+		}
+		var recent []time.Time
+		for _, at := range tracker.restarts[name] {
+			if now.Sub(at) < window {
+				recent = append(recent, at)
+			}
+		}
+		if t.MaxRestarts > 0 && len(recent) >= t.MaxRestarts {
+			l.Printf("%s restarted %d times in %s, giving up", name, len(recent), window)
+			tracker.gaveUp[name] = true
+			continue
+		}
+		tracker.restarts[name] = append(recent, now)
+		delete(tracker.crashedAt, name)
+
+		started := time.Now()
+		job.startedAt = &started
+		d.logStart(job)
+		job.err = d.runLocked(d.ctx, job, nil)
+		completed := time.Now()
+		job.completedAt = &completed
+		d.logComplete(job)
+	}
+}
+
+// reload loads the configuration again and starts/stops targets so that they
+// match it. query holds the targets resolved when doo started (before
+// --matrix, which is applied again). Targets which haven't changed are left alone. Returns nil (and
+// leaves everything running) if the new configuration is invalid.
+func (d *doo) reload(ctx context.Context, l *log.Logger, query []string) *doo {
+	next := newDoo()
+	next.ignoreDependencies = d.ignoreDependencies
+	next.useColor = d.useColor
+	next.allowedRunners = d.allowedRunners
+	next.env = d.env
+	next.createCwd = d.createCwd
+	next.maxJobs = d.maxJobs
+	next.lockAll = d.lockAll
+	next.ctx = ctx
+	next.onComplete = d.onComplete
+
+	if err := next.loadConfigs(*load); err != nil {
+		l.Printf("reload failed, keeping old configuration: %s", err)
+		return nil
+	}
+
+	var errs []string
+	next.validateTargets(&errs)
+	if len(errs) > 0 {
+		printErrors(l, errs)
+		l.Println("reload failed, keeping old configuration")
+		return nil
+	}
+
+	names, err := next.expandTargets(query)
+	if err != nil {
+		l.Printf("reload failed, keeping old configuration: %s", err)
+		return nil
+	}
+	if len(*matrix) > 0 {
+		names, err = next.addMatrixTargets(names, *matrix)
+		if err != nil {
+			l.Printf("reload failed, keeping old configuration: %s", err)
+			return nil
+		}
+	}
+
+	for _, name := range names {
+		next.createStartJob(name)
+	}
+	if errs := next.prepareCwds(); len(errs) > 0 {
+		printErrors(l, errs)
+		l.Println("reload failed, keeping old configuration")
+		return nil
+	}
+
+	running := make(map[string]bool)
+	var stale []string
+	for name, job := range d.jobs {
+		if !job.done || job.err != nil {
+			continue
+		}
+		if other, ok := next.jobs[name]; ok && job.target.sameAs(other.target) {
+			running[name] = true
+		} else {
+			stale = append(stale, name)
+		}
+	}
+
+	// Stop removed and changed targets
+	d.reset()
+	d.ignoreDependencies = true
+	for _, name := range stale {
+		d.createStopJob(name)
+	}
+	d.runAllJobs()
+
+	for name, job := range next.jobs {
+		if running[name] {
+			next.markSatisfied(job)
+		}
+	}
+	next.runAllJobs()
+
+	return next
+}
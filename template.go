@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// A templateFile is rendered with text/template before the target is started
+type templateFile struct {
+	Source      string
+	Destination string
+}
+
+// templateData is what templates can refer to, e.g. {{.Env.PORT}}
+type templateData struct {
+	Name string
+	Cwd  string
+	Env  map[string]string
+}
+
+func (tf templateFile) parse() (*template.Template, error) {
+	return template.New(filepath.Base(tf.Source)).Option("missingkey=error").ParseFiles(tf.Source)
+}
+
+// renderTemplates renders the templates of the target. The destination is
+// replaced atomically so a running service never sees a half-written file.
+func (t *Target) renderTemplates() error {
+	data := templateData{Name: t.Name, Cwd: t.Cwd, Env: t.envWithSecrets()}
+
+	for _, tf := range t.Templates {
+		tmpl, err := tf.parse()
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(0644)
+		if fi, err := os.Stat(tf.Source); err == nil {
+			mode = fi.Mode().Perm()
+		}
+
+		tmp := tf.Destination + ".doo-tmp"
+		if err := ioutil.WriteFile(tmp, buf.Bytes(), mode); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, tf.Destination); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
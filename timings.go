@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (job *Job) duration() time.Duration {
+	if job.startedAt == nil || !job.done {
+		return 0
+	}
+	return job.completedAt.Sub(*job.startedAt)
+}
+
+// criticalPath finds the chain of dependencies with the longest total
+// duration
+func (d *doo) criticalPath() ([]*Job, time.Duration) {
+	preds := make(map[*Job][]*Job)
+	for _, job := range d.jobs {
+		for _, other := range job.dependentJobs {
+			preds[other] = append(preds[other], job)
+		}
+	}
+
+	longest := make(map[*Job]time.Duration)
+	next := make(map[*Job]*Job)
+
+	var visit func(job *Job) time.Duration
+	visit = func(job *Job) time.Duration {
+		if dur, ok := longest[job]; ok {
+			return dur
+		}
+		// Guard against cycles
+		longest[job] = 0
+
+		var best time.Duration
+		for _, pred := range preds[job] {
+			if dur := visit(pred); next[job] == nil || dur > best {
+				best = dur
+				next[job] = pred
+			}
+		}
+		longest[job] = best + job.duration()
+		return longest[job]
+	}
+
+	var end *Job
+	for _, job := range d.jobs {
+		if dur := visit(job); end == nil || dur > longest[end] {
+			end = job
+		}
+	}
+
+	var path []*Job
+	for job := end; job != nil; job = next[job] {
+		path = append([]*Job{job}, path...)
+	}
+	return path, longest[end]
+}
+
+// waves groups the jobs by when they become eligible to run. All the jobs in
+// a wave can run in parallel once the previous waves are done. The jobs left
+// over are part of a cycle.
+func (d *doo) waves() ([][]string, []string) {
+	count := make(map[*Job]int)
+	succ := make(map[*Job][]*Job)
+	addEdge := func(from, to *Job) {
+		succ[from] = append(succ[from], to)
+		count[to]++
+	}
+
+	for _, job := range d.jobs {
+		for _, other := range job.dependentJobs {
+			addEdge(job, other)
+		}
+		for _, other := range job.waitingJobs {
+			addEdge(job, other)
+		}
+		if job.mode == TargetStart {
+			for _, name := range job.target.After {
+				if other, ok := d.jobs[name]; ok {
+					addEdge(other, job)
+				}
+			}
+		}
+	}
+
+	var current []*Job
+	for _, job := range d.jobs {
+		if count[job] == 0 {
+			current = append(current, job)
+		}
+	}
+
+	var res [][]string
+	done := 0
+	for len(current) > 0 {
+		var names []string
+		var next []*Job
+		for _, job := range current {
+			names = append(names, job.target.Name)
+			for _, other := range succ[job] {
+				count[other]--
+				if count[other] == 0 {
+					next = append(next, other)
+				}
+			}
+		}
+		sort.Strings(names)
+		res = append(res, names)
+		done += len(current)
+		current = next
+	}
+
+	var leftover []string
+	if done < len(d.jobs) {
+		for _, job := range d.jobs {
+			if count[job] > 0 {
+				leftover = append(leftover, job.target.Name)
+			}
+		}
+		sort.Strings(leftover)
+	}
+	return res, leftover
+}
+
+func (d *doo) printTimings() {
+	var jobs []*Job
+	var first, last *time.Time
+	for _, job := range d.jobs {
+		if !job.done {
+			continue
+		}
+		if first == nil || job.startedAt.Before(*first) {
+			first = job.startedAt
+		}
+		if last == nil || job.completedAt.After(*last) {
+			last = job.completedAt
+		}
+		if !job.isNoop() {
+			jobs = append(jobs, job)
+		}
+	}
+
+	if first == nil {
+		return
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].duration() > jobs[j].duration()
+	})
+
+	fmt.Fprintf(d.out, "\nTimings:\n")
+	for _, job := range jobs {
+		fmt.Fprintf(d.out, "  %10s  %s\n", prettyDuration(job.duration()), job.target.Name)
+	}
+
+	path, dur := d.criticalPath()
+	var names []string
+	for _, job := range path {
+		names = append(names, job.target.Name)
+	}
+	fmt.Fprintf(d.out, "Critical path: %s (%s)\n", strings.Join(names, " -> "), prettyDuration(dur))
+	fmt.Fprintf(d.out, "Total: %s\n", prettyDuration(last.Sub(*first)))
+}
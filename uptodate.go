@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// newestModTime returns the latest (or earliest) modification time of the
+// files matching the patterns. ok is false if a pattern doesn't match
+// anything.
+func newestModTime(patterns []string, newest bool) (res time.Time, ok bool) {
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			return res, false
+		}
+		for _, match := range matches {
+			fi, err := os.Stat(match)
+			if err != nil {
+				return res, false
+			}
+			mtime := fi.ModTime()
+			if res.IsZero() || newest && mtime.After(res) || !newest && mtime.Before(res) {
+				res = mtime
+			}
+		}
+	}
+	return res, true
+}
+
+// isUpToDate returns true if all of the outputs of the target are newer than
+// all of its sources, in which case there's no need to start it.
+func (t *Target) isUpToDate() bool {
+	if len(t.Outputs) == 0 {
+		return false
+	}
+
+	oldestOutput, ok := newestModTime(t.Outputs, false)
+	if !ok {
+		return false
+	}
+
+	newestSource, ok := newestModTime(t.Sources, true)
+	if !ok {
+		// A missing source is most likely a typo, so rather be safe
+		return false
+	}
+
+	return oldestOutput.After(newestSource)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// isConfigFile checks if the file has the extension of a config file
+func isConfigFile(fpath string) bool {
+	switch filepath.Ext(fpath) {
+	case ".toml", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+func isYAMLFile(fpath string) bool {
+	ext := filepath.Ext(fpath)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// decodeConfigFile decodes a TOML or YAML config file. YAML is converted to
+// TOML first so that both formats accept the same keys and unknown keys are
+// reported the same way.
+func decodeConfigFile(fpath string, v interface{}) (toml.MetaData, error) {
+	if !isYAMLFile(fpath) {
+		return toml.DecodeFile(fpath, v)
+	}
+
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return toml.MetaData{}, err
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return toml.MetaData{}, fmt.Errorf("%s: %s", fpath, err)
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(doc); err != nil {
+		return toml.MetaData{}, fmt.Errorf("%s: %s", fpath, err)
+	}
+	return toml.Decode(buf.String(), v)
+}